@@ -1,4 +1,12 @@
 #!/bin/sh
 
-/usr/sbin/update-ca-certificates
-/usr/bin/retrievault
+# The CA of Vault is given by VAULT_CACERT or by ca_cert_path, which takes
+# precedence over it, and the CAs of the PKI backends are installed by "pki_ca"
+# secrets, which run update-ca-certificates themselves. A CA mounted in the
+# trust directory, as in older versions, is still used to verify Vault if
+# VAULT_CACERT is not set, unless RETRIEVAULT_LEGACY_CA is "false".
+LEGACY_CA=/usr/local/share/ca-certificates/ca.crt
+if [ -z "$VAULT_CACERT" ] && [ "$RETRIEVAULT_LEGACY_CA" != "false" ] && [ -f "$LEGACY_CA" ]; then
+    export VAULT_CACERT="$LEGACY_CA"
+fi
+exec /usr/bin/retrievault
@@ -3,7 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/DatioBD/retrievault/retrievault"
@@ -39,8 +43,59 @@ func init() {
 			Usage:  "Log level. Can be set to  \"debug\", \"info\", \"warn\", \"error\", \"fatal\" and \"panic\"",
 			EnvVar: "RETRIEVAULT_LOG_LEVEL",
 		},
+		cli.DurationFlag{
+			Name:   "timeout",
+			Value:  30 * time.Second,
+			Usage:  "Maximum time to wait for the secrets to be fetched",
+			EnvVar: "RETRIEVAULT_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "daemon",
+			Usage:  "Keep running, renewing leases and fetching the secrets again before they expire",
+			EnvVar: "RETRIEVAULT_DAEMON",
+		},
+		cli.Float64Flag{
+			Name:   "renew-fraction",
+			Usage:  "Fraction of the lease duration after which secrets are renewed in daemon mode. Overrides the value from the configuration file",
+			EnvVar: "RETRIEVAULT_RENEW_FRACTION",
+		},
 	}
 	app.Action = run
+	app.Commands = []cli.Command{
+		{
+			Name:      "encrypt",
+			Usage:     "Encrypt files with the transit backend, printing a ciphertext per line. Reads from stdin if no file is given",
+			ArgsUsage: "[file...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "Name of the transit key",
+				},
+				cli.StringFlag{
+					Name:  "mount",
+					Value: "transit",
+					Usage: "Path where the transit backend is mounted",
+				},
+				cli.StringFlag{
+					Name:  "context",
+					Usage: "Base64 encoded context, for keys with derivation enabled",
+				},
+			},
+			Action: encrypt,
+		},
+		{
+			Name:      "exec",
+			Usage:     "Fetch the secrets and run a command with the environment variables they expose. In daemon mode, the command is restarted when they change",
+			ArgsUsage: "-- command [arg...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "signal",
+					Usage: "Signal sent to the command when the environment variables change in daemon mode, instead of restarting it",
+				},
+			},
+			Action: execCommand,
+		},
+	}
 }
 
 func run(c *cli.Context) error {
@@ -48,8 +103,13 @@ func run(c *cli.Context) error {
 	if err != nil {
 		return cli.NewExitError(fmt.Sprintf("Error setting up %s: %s", appName, err.Error()), 1)
 	}
-	timeout, _ := time.ParseDuration("30s")
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	if fraction := c.Float64("renew-fraction"); fraction != 0 {
+		rvault.RenewFraction = fraction
+	}
+	if c.Bool("daemon") {
+		return daemon(rvault, c.Duration("timeout"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
 	defer cancel()
 	log.Msg.Info("Fetching secrets...")
 	err = rvault.FetchSecrets(ctx)
@@ -60,6 +120,88 @@ func run(c *cli.Context) error {
 	return nil
 }
 
+func encrypt(c *cli.Context) error {
+	if c.String("key") == "" {
+		return cli.NewExitError("A transit key must be set with --key", 1)
+	}
+	var plaintexts [][]byte
+	if c.NArg() == 0 {
+		plaintext, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error reading stdin: %s", err.Error()), 1)
+		}
+		plaintexts = append(plaintexts, plaintext)
+	}
+	for _, file := range c.Args() {
+		plaintext, err := ioutil.ReadFile(file)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error reading %s: %s", file, err.Error()), 1)
+		}
+		plaintexts = append(plaintexts, plaintext)
+	}
+	rvault, err := retrievault.SetupApp(c.GlobalString("config"), c.GlobalString("log-file"), c.GlobalString("log-level"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error setting up %s: %s", appName, err.Error()), 1)
+	}
+	vaultPath := fmt.Sprintf("%s/encrypt/%s", c.String("mount"), c.String("key"))
+	ciphertexts, err := rvault.Encrypt(vaultPath, plaintexts, c.String("context"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error encrypting: %s", err.Error()), 1)
+	}
+	for _, ciphertext := range ciphertexts {
+		fmt.Println(ciphertext)
+	}
+	return nil
+}
+
+func execCommand(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return cli.NewExitError("A command to run must be given", 1)
+	}
+	rvault, err := retrievault.SetupApp(c.GlobalString("config"), c.GlobalString("log-file"), c.GlobalString("log-level"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error setting up %s: %s", appName, err.Error()), 1)
+	}
+	if fraction := c.GlobalFloat64("renew-fraction"); fraction != 0 {
+		rvault.RenewFraction = fraction
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Msg.WithField("signal", sig.String()).Info("Signal received. Stopping...")
+		cancel()
+	}()
+	err = rvault.Exec(ctx, c.Args(), c.GlobalDuration("timeout"), c.GlobalBool("daemon"), c.String("signal"))
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// The command failed, so retrievault exits with the same status
+		return cli.NewExitError("", exitErr.ExitCode())
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error running command: %s", err.Error()), 1)
+	}
+	return nil
+}
+
+func daemon(rvault *retrievault.RetrieVault, timeout time.Duration) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Msg.WithField("signal", sig.String()).Info("Signal received. Stopping...")
+		cancel()
+	}()
+	log.Msg.Info("Fetching secrets in daemon mode...")
+	if err := rvault.Daemon(ctx, timeout); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error retrieving secrets: %s", err.Error()), 1)
+	}
+	return nil
+}
+
 func main() {
 	app.Run(os.Args)
 }
@@ -0,0 +1,124 @@
+package retrievault
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	approle  = "approle"
+	appID    = "app-id"
+	certAuth = "cert"
+	github   = "github"
+	ldap     = "ldap"
+	userpass = "userpass"
+)
+
+// Auth holds the configuration of the method used to log in to Vault, as an
+// alternative to a static token. Method can only be one of: approle, app-id,
+// cert, github, ldap, userpass.
+type Auth struct {
+
+	// Method is the authentication method to use
+	Method string `json:"method"`
+
+	// Mount is the path where the authentication backend is mounted. If not
+	// set, the name of the method will be taken as default.
+	Mount string `json:"mount,omitempty"`
+
+	// Parameters are the credentials specific to the authentication method
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
+// readCredential returns the credential called name, taken from the first of
+// value, the content of file or the environment variable env that is set.
+func readCredential(name, value, file, env string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+	if file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	if env != "" {
+		if v := os.Getenv(env); v != "" {
+			return v, nil
+		}
+		return "", fmt.Errorf("Environment variable %s for %s is not set", env, name)
+	}
+	return "", fmt.Errorf("No %s provided", name)
+}
+
+func newAuthenticator(auth *Auth) (Authenticator, error) {
+	var err error
+	var a Authenticator
+	switch auth.Method {
+	case approle:
+		a = NewAppRole()
+		err = json.Unmarshal(auth.Parameters, a)
+	case appID:
+		a = NewAppID()
+		err = json.Unmarshal(auth.Parameters, a)
+	case certAuth:
+		a = NewCertAuth()
+		if len(auth.Parameters) != 0 {
+			err = json.Unmarshal(auth.Parameters, a)
+		}
+	case github:
+		a = NewGitHub()
+		err = json.Unmarshal(auth.Parameters, a)
+	case ldap:
+		a = NewLDAP()
+		err = json.Unmarshal(auth.Parameters, a)
+	case userpass:
+		a = NewUserPass()
+		err = json.Unmarshal(auth.Parameters, a)
+	default:
+		log.Msg.WithField("auth_method", auth.Method).Error("Invalid authentication method.")
+		return nil, fmt.Errorf("Invalid authentication method %s", auth.Method)
+	}
+
+	if err != nil {
+		log.Msg.WithFields(logrus.Fields{
+			"msg":         err.Error(),
+			"auth_method": auth.Method,
+		}).Error("Unable to unmarshall parameters for this authentication method")
+		return nil, err
+	}
+	return a, nil
+}
+
+// login logs in to Vault with the given authenticator, using the mount of
+// the authentication method, and returns the resulting token.
+func login(client *api.Client, auth *Auth, a Authenticator) (*api.SecretAuth, error) {
+	mount := auth.Mount
+	if mount == "" {
+		mount = auth.Method
+	}
+	secret, err := a.Login(client, mount)
+	if err != nil {
+		log.Msg.WithFields(logrus.Fields{
+			"msg":         err.Error(),
+			"auth_method": auth.Method,
+		}).Error("Error when logging in to Vault")
+		return nil, err
+	}
+	if secret == nil || secret.Auth == nil {
+		return nil, fmt.Errorf("No token returned when logging in with method %s", auth.Method)
+	}
+	log.Msg.WithFields(logrus.Fields{
+		"auth_method": auth.Method,
+		"policies":    strings.Join(secret.Auth.Policies, ","),
+	}).Info("Logged in to Vault")
+	return secret.Auth, nil
+}
@@ -0,0 +1,37 @@
+package retrievault
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// AppID logs in to Vault through the App ID authentication backend.
+type AppID struct {
+	AppID      string `json:"app_id,omitempty"`
+	AppIDFile  string `json:"app_id_file,omitempty"`
+	AppIDEnv   string `json:"app_id_env,omitempty"`
+	UserID     string `json:"user_id,omitempty"`
+	UserIDFile string `json:"user_id_file,omitempty"`
+	UserIDEnv  string `json:"user_id_env,omitempty"`
+}
+
+func NewAppID() *AppID {
+	return new(AppID)
+}
+
+// Login logs in to Vault using the App ID backend mounted at mount.
+func (a *AppID) Login(client *api.Client, mount string) (*api.Secret, error) {
+	appID, err := readCredential("app_id", a.AppID, a.AppIDFile, a.AppIDEnv)
+	if err != nil {
+		return nil, err
+	}
+	userID, err := readCredential("user_id", a.UserID, a.UserIDFile, a.UserIDEnv)
+	if err != nil {
+		return nil, err
+	}
+	return client.Logical().Write(fmt.Sprintf("auth/%s/login", mount), map[string]interface{}{
+		"app_id":  appID,
+		"user_id": userID,
+	})
+}
@@ -0,0 +1,67 @@
+package retrievault
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// AppRole logs in to Vault through the AppRole authentication backend.
+type AppRole struct {
+	RoleID          string `json:"role_id,omitempty"`
+	RoleIDFile      string `json:"role_id_file,omitempty"`
+	RoleIDEnv       string `json:"role_id_env,omitempty"`
+	SecretID        string `json:"secret_id,omitempty"`
+	SecretIDFile    string `json:"secret_id_file,omitempty"`
+	SecretIDEnv     string `json:"secret_id_env,omitempty"`
+	SecretIDWrapped bool   `json:"secret_id_wrapped,omitempty"`
+
+	// secretID is the secret_id obtained from a response-wrapping token.
+	// As those can be used only once, it is kept to log in again later.
+	secretID string
+}
+
+func NewAppRole() *AppRole {
+	return new(AppRole)
+}
+
+// Login logs in to Vault using the AppRole backend mounted at mount. If the
+// secret_id is wrapped, it is unwrapped first.
+func (a *AppRole) Login(client *api.Client, mount string) (*api.Secret, error) {
+	roleID, err := readCredential("role_id", a.RoleID, a.RoleIDFile, a.RoleIDEnv)
+	if err != nil {
+		return nil, err
+	}
+	secretID := a.secretID
+	if secretID == "" {
+		secretID, err = readCredential("secret_id", a.SecretID, a.SecretIDFile, a.SecretIDEnv)
+		if err != nil {
+			return nil, err
+		}
+		if a.SecretIDWrapped {
+			unwrapped, err := unwrap(client, secretID)
+			if err != nil {
+				return nil, err
+			}
+			if err := a.setWrappedSecretID(unwrapped); err != nil {
+				return nil, err
+			}
+			secretID = a.secretID
+		}
+	}
+	return client.Logical().Write(fmt.Sprintf("auth/%s/login", mount), map[string]interface{}{
+		"role_id":   roleID,
+		"secret_id": secretID,
+	})
+}
+
+// setWrappedSecretID sets the secret_id held in an unwrapped response as the
+// one to use from now on.
+func (a *AppRole) setWrappedSecretID(unwrapped *api.Secret) error {
+	id, ok := unwrapped.Data["secret_id"].(string)
+	if !ok || id == "" {
+		return fmt.Errorf("No secret_id found in the wrapped response")
+	}
+	a.secretID = id
+	return nil
+}
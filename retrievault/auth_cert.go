@@ -0,0 +1,29 @@
+package retrievault
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// CertAuth logs in to Vault through the TLS certificates authentication
+// backend, using the client certificate configured for the connection.
+type CertAuth struct {
+
+	// Name is the name of the certificate role to authenticate against. If
+	// not set, every role is tried.
+	Name string `json:"name,omitempty"`
+}
+
+func NewCertAuth() *CertAuth {
+	return new(CertAuth)
+}
+
+// Login logs in to Vault using the TLS certificates backend mounted at mount.
+func (a *CertAuth) Login(client *api.Client, mount string) (*api.Secret, error) {
+	data := map[string]interface{}{}
+	if a.Name != "" {
+		data["name"] = a.Name
+	}
+	return client.Logical().Write(fmt.Sprintf("auth/%s/login", mount), data)
+}
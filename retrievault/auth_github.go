@@ -0,0 +1,30 @@
+package retrievault
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// GitHub logs in to Vault through the GitHub authentication backend, using a
+// GitHub personal access token.
+type GitHub struct {
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"token_file,omitempty"`
+	TokenEnv  string `json:"token_env,omitempty"`
+}
+
+func NewGitHub() *GitHub {
+	return new(GitHub)
+}
+
+// Login logs in to Vault using the GitHub backend mounted at mount.
+func (a *GitHub) Login(client *api.Client, mount string) (*api.Secret, error) {
+	token, err := readCredential("token", a.Token, a.TokenFile, a.TokenEnv)
+	if err != nil {
+		return nil, err
+	}
+	return client.Logical().Write(fmt.Sprintf("auth/%s/login", mount), map[string]interface{}{
+		"token": token,
+	})
+}
@@ -0,0 +1,11 @@
+package retrievault
+
+// LDAP logs in to Vault through the LDAP authentication backend. It takes
+// the same credentials as the Username & Password backend.
+type LDAP struct {
+	UserPass
+}
+
+func NewLDAP() *LDAP {
+	return new(LDAP)
+}
@@ -0,0 +1,123 @@
+package retrievault
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+type testcredential struct {
+	value    string
+	file     string
+	env      string
+	expected string
+	e        bool
+}
+
+func TestReadCredential(t *testing.T) {
+	file, err := ioutil.TempFile("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("from-file\n")
+	file.Close()
+	os.Setenv("RETRIEVAULT_TEST_CREDENTIAL", "from-env")
+	defer os.Unsetenv("RETRIEVAULT_TEST_CREDENTIAL")
+
+	testpairs := []*testcredential{
+		&testcredential{"value", file.Name(), "RETRIEVAULT_TEST_CREDENTIAL", "value", false},
+		&testcredential{"", file.Name(), "RETRIEVAULT_TEST_CREDENTIAL", "from-file", false},
+		&testcredential{"", "", "RETRIEVAULT_TEST_CREDENTIAL", "from-env", false},
+		&testcredential{"", "", "RETRIEVAULT_TEST_UNSET", "", true},
+		&testcredential{"", "/nonexistent", "", "", true},
+		&testcredential{"", "", "", "", true},
+	}
+	for _, pair := range testpairs {
+		credential, err := readCredential("test", pair.value, pair.file, pair.env)
+		if pair.e {
+			if err == nil {
+				t.Error("For", pair,
+					"expected non nil error",
+					"got nil error")
+			}
+		} else if credential != pair.expected {
+			t.Error("For", pair,
+				"expected", pair.expected,
+				"got", credential)
+		}
+	}
+}
+
+type testauthenticator struct {
+	auth *Auth
+	path string
+	body map[string]interface{}
+}
+
+var testauthenticators = []*testauthenticator{
+	&testauthenticator{
+		&Auth{Method: "approle", Parameters: json.RawMessage(`{"role_id":"role","secret_id":"secret"}`)},
+		"/v1/auth/approle/login",
+		map[string]interface{}{"role_id": "role", "secret_id": "secret"},
+	},
+	&testauthenticator{
+		&Auth{Method: "app-id", Parameters: json.RawMessage(`{"app_id":"app","user_id":"user"}`)},
+		"/v1/auth/app-id/login",
+		map[string]interface{}{"app_id": "app", "user_id": "user"},
+	},
+	&testauthenticator{
+		&Auth{Method: "cert", Mount: "tls"},
+		"/v1/auth/tls/login",
+		map[string]interface{}{},
+	},
+	&testauthenticator{
+		&Auth{Method: "github", Parameters: json.RawMessage(`{"token":"gh"}`)},
+		"/v1/auth/github/login",
+		map[string]interface{}{"token": "gh"},
+	},
+	&testauthenticator{
+		&Auth{Method: "ldap", Parameters: json.RawMessage(`{"username":"john","password":"pass"}`)},
+		"/v1/auth/ldap/login/john",
+		map[string]interface{}{"password": "pass"},
+	},
+	&testauthenticator{
+		&Auth{Method: "userpass", Parameters: json.RawMessage(`{"username":"john","password":"pass"}`)},
+		"/v1/auth/userpass/login/john",
+		map[string]interface{}{"password": "pass"},
+	},
+}
+
+func TestLogin(t *testing.T) {
+	for _, pair := range testauthenticators {
+		client, requests, stop := testVault(t, map[string]interface{}{
+			pair.path: map[string]interface{}{
+				"auth": map[string]interface{}{"client_token": "token"},
+			},
+		})
+		m, err := newTokenManager(client, pair.auth)
+		if err != nil {
+			t.Error("For", pair.auth.Method, "expected nil error", "got", err)
+		} else if err := m.login(); err != nil {
+			t.Error("For", pair.auth.Method, "expected nil error", "got", err)
+		} else if client.Token() != "token" {
+			t.Error("For", pair.auth.Method, "expected", "token", "got", client.Token())
+		}
+		stop()
+		if len(*requests) != 1 {
+			t.Error("For", pair.auth.Method, "expected 1 request", "got", len(*requests))
+			continue
+		}
+		if !reflect.DeepEqual((*requests)[0].body, pair.body) {
+			t.Error("For", pair.auth.Method, "expected", pair.body, "got", (*requests)[0].body)
+		}
+	}
+}
+
+func TestLoginInvalidMethod(t *testing.T) {
+	if _, err := newTokenManager(nil, &Auth{Method: "foo"}); err == nil {
+		t.Error("For", "foo", "expected non nil error", "got nil error")
+	}
+}
@@ -0,0 +1,37 @@
+package retrievault
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// UserPass logs in to Vault through the Username & Password authentication
+// backend.
+type UserPass struct {
+	Username     string `json:"username,omitempty"`
+	UsernameFile string `json:"username_file,omitempty"`
+	UsernameEnv  string `json:"username_env,omitempty"`
+	Password     string `json:"password,omitempty"`
+	PasswordFile string `json:"password_file,omitempty"`
+	PasswordEnv  string `json:"password_env,omitempty"`
+}
+
+func NewUserPass() *UserPass {
+	return new(UserPass)
+}
+
+// Login logs in to Vault using the backend mounted at mount.
+func (a *UserPass) Login(client *api.Client, mount string) (*api.Secret, error) {
+	username, err := readCredential("username", a.Username, a.UsernameFile, a.UsernameEnv)
+	if err != nil {
+		return nil, err
+	}
+	password, err := readCredential("password", a.Password, a.PasswordFile, a.PasswordEnv)
+	if err != nil {
+		return nil, err
+	}
+	return client.Logical().Write(fmt.Sprintf("auth/%s/login/%s", mount, username), map[string]interface{}{
+		"password": password,
+	})
+}
@@ -0,0 +1,262 @@
+package retrievault
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	awsCredentialsFormat = "credentials"
+	awsEnvFormat         = "env"
+	awsDefaultProfile    = "default"
+)
+
+// AWS fetches dynamic credentials from the AWS backend, either IAM user
+// credentials from "aws/creds/<role>" or STS credentials from
+// "aws/sts/<role>", and writes them in the format expected by the AWS SDKs.
+type AWS struct {
+
+	// Format is the format of the file written: "credentials" for a shared
+	// credentials file (~/.aws/credentials), or "env" for a file of
+	// environment variables. Defaults to "credentials".
+	Format string `json:"format,omitempty"`
+
+	// Profile is the profile of the shared credentials file to write. Any
+	// other profile in the file is kept as is. Defaults to "default".
+	Profile string `json:"profile,omitempty"`
+
+	// TTL is the requested Time To Live of STS credentials
+	TTL string `json:"ttl,omitempty"`
+
+	// Revoke revokes the lease of the credentials when the daemon stops
+	Revoke bool `json:"revoke_on_shutdown,omitempty"`
+
+	fileParameters
+	secret *api.Secret
+	writer
+}
+
+func NewAWS() *AWS {
+	return new(AWS)
+}
+
+// Lease returns the last credentials fetched.
+func (a *AWS) Lease() *api.Secret {
+	return a.secret
+}
+
+// RevokeOnShutdown reports whether the lease of the credentials must be
+// revoked when the daemon stops.
+func (a *AWS) RevokeOnShutdown() bool {
+	return a.Revoke
+}
+
+// awsCredentials are the credentials issued by the AWS backend.
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// read fetches the credentials at vaultPath. STS credentials are requested
+// with a write, so that a TTL can be given.
+func (a *AWS) read(client *api.Logical, vaultPath string) (*api.Secret, error) {
+	if strings.Contains(strings.Trim(vaultPath, "/"), "/sts/") {
+		data := map[string]interface{}{}
+		if a.TTL != "" {
+			data["ttl"] = a.TTL
+		}
+		return client.Write(vaultPath, data)
+	}
+	return client.Read(vaultPath)
+}
+
+// env renders the credentials as environment variables.
+func (c *awsCredentials) env() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "AWS_ACCESS_KEY_ID=%s\n", c.accessKey)
+	fmt.Fprintf(&buf, "AWS_SECRET_ACCESS_KEY=%s\n", c.secretKey)
+	if c.sessionToken != "" {
+		fmt.Fprintf(&buf, "AWS_SESSION_TOKEN=%s\n", c.sessionToken)
+	}
+	return buf.Bytes()
+}
+
+// profile renders the credentials as a profile section of a shared
+// credentials file.
+func (c *awsCredentials) profile(name string) []string {
+	lines := []string{
+		fmt.Sprintf("[%s]", name),
+		fmt.Sprintf("aws_access_key_id = %s", c.accessKey),
+		fmt.Sprintf("aws_secret_access_key = %s", c.secretKey),
+	}
+	if c.sessionToken != "" {
+		lines = append(lines, fmt.Sprintf("aws_session_token = %s", c.sessionToken))
+	}
+	return lines
+}
+
+// setProfile replaces the section of the given profile in the content of a
+// shared credentials file, or appends it if it doesn't exist yet.
+func setProfile(content []byte, name string, section []string) []byte {
+	var (
+		lines    []string
+		found    bool
+		skipping bool
+	)
+	if len(content) != 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+			trimmed := strings.TrimSpace(line)
+			if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+				if skipping {
+					// Keep the sections apart, as the blank line that
+					// separated them belonged to the replaced one
+					lines = append(lines, "")
+				}
+				skipping = strings.TrimSpace(trimmed[1:len(trimmed)-1]) == name
+				if skipping {
+					found = true
+					lines = append(lines, section...)
+					continue
+				}
+			}
+			if !skipping {
+				lines = append(lines, line)
+			}
+		}
+	}
+	if !found {
+		if len(lines) != 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, section...)
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// profileLocks serializes the updates of each shared file holding profiles,
+// as the secrets setting their own profile in the same file are fetched
+// concurrently.
+var profileLocks = struct {
+	sync.Mutex
+	files map[string]*sync.Mutex
+}{files: make(map[string]*sync.Mutex)}
+
+// lockProfiles locks the given file until the function returned is called.
+func lockProfiles(file string) func() {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	profileLocks.Lock()
+	mu, ok := profileLocks.files[file]
+	if !ok {
+		mu = new(sync.Mutex)
+		profileLocks.files[file] = mu
+	}
+	profileLocks.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// writeProfile sets the section of the given profile in a shared file, and
+// writes it. The file is locked from the moment it is read until it is
+// written, so that the profiles set meanwhile by other secrets aren't lost.
+// In memory, the file on disk is ignored, and only holds the given profile.
+func (w *writer) writeProfile(file, name string, section []string, perm os.FileMode, e chan error) {
+	if w.inMemory() {
+		w.writeInFile(file, setProfile(nil, name, section), perm, e)
+		return
+	}
+	unlock := lockProfiles(file)
+	defer unlock()
+	current, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		e <- err
+		return
+	}
+	w.writeInFile(file, setProfile(current, name, section), perm, e)
+}
+
+func (a *AWS) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
+	format := a.Format
+	if format == "" {
+		format = awsCredentialsFormat
+	}
+	profile := a.Profile
+	if profile == "" {
+		profile = awsDefaultProfile
+	}
+	if format != awsCredentialsFormat && format != awsEnvFormat {
+		e <- fmt.Errorf("Invalid format %s for AWS credentials. Must be one of: %s, %s", format, awsCredentialsFormat, awsEnvFormat)
+		return
+	}
+	defaultFile := "credentials"
+	if format == awsEnvFormat {
+		defaultFile = "aws.env"
+	}
+	file, perm, err := a.getDestAndPerms(defaultFile, a.fileParameters, dest)
+	if err != nil {
+		log.Msg.WithFields(logrus.Fields{
+			"format":      format,
+			"permissions": perm,
+		}).Error(err.Error())
+		e <- err
+		return
+	}
+
+	log.Msg.WithField("vault_path", vaultPath).Debug("Fetching secret at path")
+	secret, err := a.read(client, vaultPath)
+	if err != nil {
+		e <- err
+		return
+	}
+	if secret == nil {
+		e <- fmt.Errorf("No credentials found at path %s", vaultPath)
+		return
+	}
+	a.secret = secret
+	creds := new(awsCredentials)
+	creds.accessKey, _ = secret.Data["access_key"].(string)
+	creds.secretKey, _ = secret.Data["secret_key"].(string)
+	creds.sessionToken, _ = secret.Data["security_token"].(string)
+	if creds.accessKey == "" || creds.secretKey == "" {
+		e <- fmt.Errorf("No access key or secret key found at path %s", vaultPath)
+		return
+	}
+	log.Msg.WithFields(logrus.Fields{
+		"vault_path": vaultPath,
+		"lease_id":   secret.LeaseID,
+		"access_key": creds.accessKey,
+	}).Info("AWS credentials issued")
+
+	er := make(chan error, 1)
+	if format == awsEnvFormat {
+		go a.writeInFile(file, creds.env(), perm, er)
+	} else {
+		go a.writeProfile(file, profile, creds.profile(profile), perm, er)
+	}
+	select {
+	case <-ctx.Done():
+		log.Msg.Error("Parent context cancelled")
+		e <- ctx.Err()
+		return
+	case err := <-er:
+		if err != nil {
+			log.Msg.Error("Error when writing secret to file")
+			e <- err
+			return
+		}
+	}
+	e <- nil
+	return
+}
@@ -0,0 +1,150 @@
+package retrievault
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+type testprofile struct {
+	content  string
+	expected string
+}
+
+var testprofiles = []*testprofile{
+	&testprofile{"", "[default]\nkey = new\n"},
+	&testprofile{"[default]\nkey = old\n", "[default]\nkey = new\n"},
+	&testprofile{"[other]\nkey = other\n", "[other]\nkey = other\n\n[default]\nkey = new\n"},
+	&testprofile{
+		"[default]\nkey = old\n\n[other]\nkey = other\n",
+		"[default]\nkey = new\n\n[other]\nkey = other\n",
+	},
+}
+
+func TestSetProfile(t *testing.T) {
+	for _, pair := range testprofiles {
+		result := setProfile([]byte(pair.content), "default", []string{"[default]", "key = new"})
+		if string(result) != pair.expected {
+			t.Error("For", pair.content, "expected", pair.expected, "got", string(result))
+		}
+	}
+}
+
+func TestAWSFetchSecret(t *testing.T) {
+	client, requests, stop := testVault(t, map[string]interface{}{
+		"/v1/aws/sts/deploy": map[string]interface{}{
+			"lease_id":       "aws/sts/deploy/1234",
+			"lease_duration": 3600,
+			"data": map[string]interface{}{
+				"access_key":     "AKIA",
+				"secret_key":     "secret",
+				"security_token": "token",
+			},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "credentials"), []byte("[other]\naws_access_key_id = other\n"), 0600)
+
+	a := &AWS{Profile: "deploy", TTL: "1h"}
+	e := make(chan error, 1)
+	a.FetchSecret(context.Background(), "aws/sts/deploy", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if req := (*requests)[0]; req.method != "PUT" || req.body["ttl"] != "1h" {
+		t.Error("Expected STS credentials to be requested with a ttl, got", req.method, req.body)
+	}
+	expected := "[other]\naws_access_key_id = other\n\n[deploy]\naws_access_key_id = AKIA\naws_secret_access_key = secret\naws_session_token = token\n"
+	content, _ := ioutil.ReadFile(path.Join(dir, "credentials"))
+	if string(content) != expected {
+		t.Error("Expected", expected, "got", string(content))
+	}
+
+	a = &AWS{Format: awsEnvFormat}
+	a.FetchSecret(context.Background(), "aws/sts/deploy", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	expected = "AWS_ACCESS_KEY_ID=AKIA\nAWS_SECRET_ACCESS_KEY=secret\nAWS_SESSION_TOKEN=token\n"
+	content, _ = ioutil.ReadFile(path.Join(dir, "aws.env"))
+	if string(content) != expected {
+		t.Error("Expected", expected, "got", string(content))
+	}
+}
+
+func TestAWSFetchSecretSharedFile(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/aws/creds/deploy": map[string]interface{}{
+			"data": map[string]interface{}{"access_key": "AKIA", "secret_key": "secret"},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every profile is kept when they are set concurrently in the same file
+	profiles := []string{"dev", "staging", "prod", "ci", "ops"}
+	errs := make(chan error, len(profiles))
+	for _, profile := range profiles {
+		go func(profile string) {
+			e := make(chan error, 1)
+			a := &AWS{Profile: profile}
+			a.FetchSecret(context.Background(), "aws/creds/deploy", dir, client.Logical(), e)
+			errs <- <-e
+		}(profile)
+	}
+	for range profiles {
+		if err := <-errs; err != nil {
+			t.Fatal("Expected nil error, got", err)
+		}
+	}
+	content, _ := ioutil.ReadFile(path.Join(dir, "credentials"))
+	for _, profile := range profiles {
+		if !strings.Contains(string(content), "["+profile+"]") {
+			t.Error("For", profile, "expected its profile in", string(content))
+		}
+	}
+}
+
+func TestAWSFetchSecretInMemory(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/aws/creds/deploy": map[string]interface{}{
+			"data": map[string]interface{}{"access_key": "AKIA", "secret_key": "secret"},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	current := "[other]\naws_access_key_id = OTHER\n"
+	ioutil.WriteFile(path.Join(dir, "credentials"), []byte(current), 0600)
+
+	// The profiles of the file on disk aren't merged in
+	a := &AWS{Profile: "deploy"}
+	a.keepInMemory()
+	e := make(chan error, 1)
+	a.FetchSecret(context.Background(), "aws/creds/deploy", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	content := string(a.memoryFiles()[path.Join(dir, "credentials")])
+	if !strings.Contains(content, "[deploy]") || strings.Contains(content, "[other]") {
+		t.Error("Expected only the deploy profile, got", content)
+	}
+	if data, _ := ioutil.ReadFile(path.Join(dir, "credentials")); string(data) != current {
+		t.Error("Expected the file on disk to be left untouched, got", string(data))
+	}
+}
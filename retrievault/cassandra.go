@@ -0,0 +1,95 @@
+package retrievault
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// cqlshrcSection is the section of a cqlshrc file holding the credentials.
+const cqlshrcSection = "authentication"
+
+// Cassandra fetches dynamic credentials from the Cassandra backend, reading
+// them from the "cassandra/creds/<role>" path, and writes them in the
+// [authentication] section of a cqlshrc file. Any other section in the file
+// is kept as is.
+type Cassandra struct {
+
+	// Revoke revokes the lease of the credentials when the daemon stops
+	Revoke bool `json:"revoke_on_shutdown,omitempty"`
+
+	fileParameters
+	secret *api.Secret
+	writer
+}
+
+func NewCassandra() *Cassandra {
+	return new(Cassandra)
+}
+
+// Lease returns the last credentials fetched.
+func (c *Cassandra) Lease() *api.Secret {
+	return c.secret
+}
+
+// RevokeOnShutdown reports whether the lease of the credentials must be
+// revoked when the daemon stops.
+func (c *Cassandra) RevokeOnShutdown() bool {
+	return c.Revoke
+}
+
+func (c *Cassandra) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
+	file, perm, err := c.getDestAndPerms("cqlshrc", c.fileParameters, dest)
+	if err != nil {
+		log.Msg.WithField("permissions", perm).Error(err.Error())
+		e <- err
+		return
+	}
+
+	log.Msg.WithField("vault_path", vaultPath).Debug("Fetching secret at path")
+	secret, err := client.Read(vaultPath)
+	if err != nil {
+		e <- err
+		return
+	}
+	if secret == nil {
+		e <- fmt.Errorf("No credentials found at path %s", vaultPath)
+		return
+	}
+	c.secret = secret
+	username, _ := secret.Data["username"].(string)
+	password, _ := secret.Data["password"].(string)
+	if username == "" || password == "" {
+		e <- fmt.Errorf("No username or password found at path %s", vaultPath)
+		return
+	}
+	log.Msg.WithFields(logrus.Fields{
+		"vault_path": vaultPath,
+		"lease_id":   secret.LeaseID,
+	}).Info("Cassandra credentials issued")
+
+	section := []string{
+		fmt.Sprintf("[%s]", cqlshrcSection),
+		fmt.Sprintf("username = %s", username),
+		fmt.Sprintf("password = %s", password),
+	}
+	er := make(chan error, 1)
+	go c.writeProfile(file, cqlshrcSection, section, perm, er)
+	select {
+	case <-ctx.Done():
+		log.Msg.Error("Parent context cancelled")
+		e <- ctx.Err()
+		return
+	case err := <-er:
+		if err != nil {
+			log.Msg.Error("Error when writing secret to file")
+			e <- err
+			return
+		}
+	}
+	e <- nil
+	return
+}
@@ -0,0 +1,45 @@
+package retrievault
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCassandraFetchSecret(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/cassandra/creds/readonly": map[string]interface{}{
+			"lease_id":       "cassandra/creds/readonly/1234",
+			"lease_duration": 3600,
+			"data":           map[string]interface{}{"username": "vault-1234", "password": "secret"},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Other sections of an existing cqlshrc are kept
+	current := "[connection]\nhostname = cassandra\nport = 9042\n\n[authentication]\nusername = old\npassword = old\n"
+	if err := ioutil.WriteFile(path.Join(dir, "cqlshrc"), []byte(current), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := NewCassandra()
+	e := make(chan error, 1)
+	c.FetchSecret(context.Background(), "cassandra/creds/readonly", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	expected := "[connection]\nhostname = cassandra\nport = 9042\n\n[authentication]\nusername = vault-1234\npassword = secret\n"
+	content, _ := ioutil.ReadFile(path.Join(dir, "cqlshrc"))
+	if string(content) != expected {
+		t.Error("For", "cqlshrc", "expected", expected, "got", string(content))
+	}
+	if lease := c.Lease(); lease == nil || lease.LeaseID != "cassandra/creds/readonly/1234" {
+		t.Error("Expected lease", "cassandra/creds/readonly/1234", "got", lease)
+	}
+}
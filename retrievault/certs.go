@@ -3,8 +3,8 @@ package retrievault
 import (
 	"context"
 	"fmt"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/DatioBD/retrievault/utils/log"
 	"github.com/Sirupsen/logrus"
@@ -26,7 +26,31 @@ type Certs struct {
 	Key        certParams `json:"key,omitempty"`
 	Cert       certParams `json:"cert,omitempty"`
 	CACert     certParams `json:"ca_cert,omitempty"`
-	secret     *api.Secret
+
+	// Mode is either "issue", to have Vault generate a new private key on
+	// each run, or "sign", to keep a local private key and have Vault sign a
+	// CSR for it. Defaults to "issue".
+	Mode string `json:"mode,omitempty"`
+
+	// KeyType is the type of the private key generated in "sign" mode, if
+	// there is none yet: "rsa" or "ec". Defaults to "rsa".
+	KeyType string `json:"key_type,omitempty"`
+
+	// KeyBits is the size of the private key generated in "sign" mode.
+	// Defaults to 2048 for RSA keys and 256 for EC keys.
+	KeyBits int `json:"key_bits,omitempty"`
+
+	// RenewBefore is how long before the end of its validity period the
+	// certificate is renewed, e.g. "720h". Until then, the certificate on
+	// disk is kept as long as it matches the names requested. Defaults to
+	// the last third of its validity period.
+	RenewBefore string `json:"renew_before,omitempty"`
+
+	// Outputs are additional files where the certificate is written, in
+	// formats like PKCS#12 or Java keystores
+	Outputs []certOutput `json:"outputs,omitempty"`
+
+	secret *api.Secret
 	writer
 }
 
@@ -63,23 +87,72 @@ func (c *Certs) processArraySecret(secret interface{}) ([]byte, error) {
 	return CAs, nil
 }
 
-func (c *Certs) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
-	log.Msg.WithField("vault_path", vaultPath).Debug("Fetching secret at path")
-	secrets, err := client.Write(vaultPath, map[string]interface{}{
+// Lease returns the last certificate issued.
+func (c *Certs) Lease() *api.Secret {
+	return c.secret
+}
+
+// request returns the parameters of the certificate requested.
+func (c *Certs) request() map[string]interface{} {
+	return map[string]interface{}{
 		"common_name": c.CommonName,
 		"ttl":         c.TTL,
 		"alt_names":   strings.Join(c.AltNames, ","),
 		"ip_sans":     strings.Join(c.IPSans, ","),
-	})
+	}
+}
+
+func (c *Certs) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
+	log.Msg.WithField("vault_path", vaultPath).Debug("Fetching secret at path")
+	keyFile, _, err := c.getDestAndPerms("cert.key", c.Key.fileParameters, dest)
 	if err != nil {
 		e <- err
 		return
 	}
+	certFile, _, err := c.getDestAndPerms("cert.crt", c.Cert.fileParameters, dest)
+	if err != nil {
+		e <- err
+		return
+	}
+	// In memory, nothing on disk belongs to this run, so a new certificate
+	// is always issued
+	if c.inMemory() {
+		log.Msg.Debug("Keeping certificate in memory")
+	} else if !c.outputsExist(dest) {
+		log.Msg.Debug("Certificate outputs missing")
+	} else if cert := c.current(client, vaultPath, certFile, keyFile); cert != nil {
+		c.secret = &api.Secret{LeaseDuration: int(time.Until(cert.NotAfter).Seconds())}
+		e <- nil
+		return
+	}
 
-	er := make(chan error)
-	var certificateData []byte
-	var caChainData []byte
-	wait := 0
+	var (
+		secrets *api.Secret
+		keyData []byte
+	)
+	switch c.Mode {
+	case "", certsIssueMode:
+		secrets, err = client.Write(vaultPath, c.request())
+	case certsSignMode:
+		secrets, keyData, err = c.sign(client, vaultPath, keyFile)
+	default:
+		err = fmt.Errorf("Invalid mode %s for certificates. Must be one of: %s, %s", c.Mode, certsIssueMode, certsSignMode)
+	}
+	if err != nil {
+		e <- err
+		return
+	}
+	if secrets == nil {
+		e <- fmt.Errorf("No certificate issued at path %s", vaultPath)
+		return
+	}
+	c.secret = secrets
+
+	var (
+		caData          []byte
+		certificateData []byte
+		caChainData     []byte
+	)
 	for key, secret := range secrets.Data {
 		select {
 		case <-ctx.Done():
@@ -89,151 +162,75 @@ func (c *Certs) FetchSecret(ctx context.Context, vaultPath, dest string, client
 		default:
 		}
 
+		var err error
 		switch key {
 		case issuingCA:
-			wait++
-
-			var (
-				file string
-				data []byte
-				perm os.FileMode
-				err  error
-			)
-
-			file, perm, err = c.getDestAndPerms("ca.crt", c.CACert.fileParameters, dest)
-			if err != nil {
-				log.Msg.WithFields(logrus.Fields{
-					"secret":      key,
-					"permissions": perm,
-				}).Error(err.Error())
-				e <- err
-				return
-			}
-			data, err = c.processSingleSecret(secret)
-
-			if err != nil {
-				log.Msg.WithFields(logrus.Fields{
-					"secret":      key,
-					"permissions": perm,
-				}).Error(err.Error())
-				e <- err
-				return
-			}
-
-			go c.writeInFile(file, data, perm, er)
-
+			caData, err = c.processSingleSecret(secret)
 		case privateKey:
-			wait++
-
-			var (
-				file string
-				data []byte
-				perm os.FileMode
-				err  error
-			)
-
-			file, perm, err = c.getDestAndPerms("cert.key", c.Key.fileParameters, dest)
-			if err != nil {
-				log.Msg.WithFields(logrus.Fields{
-					"secret": key,
-				}).Error(err.Error())
-				e <- err
-				return
-			}
-			data, err = c.processSingleSecret(secret)
-
-			if err != nil {
-				log.Msg.WithFields(logrus.Fields{
-					"secret": key,
-				}).Error(err.Error())
-				e <- err
-				return
-			}
-
-			go c.writeInFile(file, data, perm, er)
-
+			keyData, err = c.processSingleSecret(secret)
 		case certificate:
-
-			var (
-				file string
-				perm os.FileMode
-				err  error
-			)
-			file, perm, err = c.getDestAndPerms("cert.crt", c.Cert.fileParameters, dest)
-			if err != nil {
-				log.Msg.WithFields(logrus.Fields{
-					"secret":      key,
-					"permissions": perm,
-				}).Error(err.Error())
-				e <- err
-				return
-			}
-
 			certificateData, err = c.processSingleSecret(secret)
-
-			if err != nil {
-				log.Msg.WithFields(logrus.Fields{
-					"secret": key,
-				}).Error(err.Error())
-				e <- err
-				return
-			}
-
-			if len(caChainData) > 0 {
-				wait++
-				certificateData = append(certificateData, caChainData...)
-				go c.writeInFile(file, certificateData, perm, er)
-			}
-
 		case CAChain:
-
-			var (
-				file string
-				perm os.FileMode
-				err  error
-			)
-			file, perm, err = c.getDestAndPerms("cert.crt", c.Cert.fileParameters, dest)
-			if err != nil {
-				log.Msg.WithFields(logrus.Fields{
-					"secret":      key,
-					"permissions": perm,
-				}).Error(err.Error())
-				e <- err
-				return
-			}
-
 			caChainData, err = c.processArraySecret(secret)
-
-			if err != nil {
-				log.Msg.WithFields(logrus.Fields{
-					"secret": key,
-				}).Error(err.Error())
-				e <- err
-				return
-			}
-
-			if len(certificateData) > 0 {
-				wait++
-				certificateData = append(certificateData, caChainData...)
-				go c.writeInFile(file, certificateData, perm, er)
-			}
 		default:
 			continue
 		}
+		if err != nil {
+			log.Msg.WithFields(logrus.Fields{
+				"secret": key,
+			}).Error(err.Error())
+			e <- err
+			return
+		}
 	}
 
-	for i := 0; i < wait; i++ {
-		select {
-		case <-ctx.Done():
-			log.Msg.Error("Parent context cancelled")
-			e <- ctx.Err()
+	// The key, the certificate and the CA are switched together, so that a
+	// consumer never loads a new certificate next to an old key
+	var files []*fileContent
+	for _, f := range []struct {
+		name        string
+		defaultFile string
+		params      fileParameters
+		data        []byte
+	}{
+		{issuingCA, "ca.crt", c.CACert.fileParameters, caData},
+		{privateKey, "cert.key", c.Key.fileParameters, keyData},
+		{certificate, "cert.crt", c.Cert.fileParameters, append(certificateData, caChainData...)},
+	} {
+		if len(f.data) == 0 {
+			continue
+		}
+		file, perm, err := c.getDestAndPerms(f.defaultFile, f.params, dest)
+		if err != nil {
+			log.Msg.WithFields(logrus.Fields{
+				"secret":      f.name,
+				"permissions": perm,
+			}).Error(err.Error())
+			e <- err
+			return
+		}
+		files = append(files, &fileContent{path: file, data: f.data, perm: perm})
+	}
+	outputs, err := c.outputs(client, keyData, append(certificateData, caChainData...), caData, dest)
+	if err != nil {
+		log.Msg.WithField("msg", err.Error()).Error("Error when building certificate outputs")
+		e <- err
+		return
+	}
+	files = append(files, outputs...)
+
+	er := make(chan error, 1)
+	go c.writeInFiles(files, er)
+	select {
+	case <-ctx.Done():
+		log.Msg.Error("Parent context cancelled")
+		e <- ctx.Err()
+		return
+	case err := <-er:
+		if err != nil {
+			log.Msg.Error("Error when writing secret to file")
+			e <- err
 			return
-		case err := <-er:
-			if err != nil {
-				log.Msg.Error("Error when writing secret to file")
-				e <- err
-				return
-			}
 		}
 	}
 
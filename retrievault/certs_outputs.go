@@ -0,0 +1,272 @@
+package retrievault
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pavel-v-chernykh/keystore-go"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	pemOutput      = "pem"
+	pkcs12Output   = "pkcs12"
+	jksOutput      = "jks"
+	defaultAlias   = "cert"
+	outputKeyPerm  = "0600"
+	truststoreFile = "truststore.jks"
+	jksCertType    = "X.509"
+)
+
+// certOutput is an additional file, in a format other than the separate PEM
+// files, where the certificate issued is written. Format can only be one of:
+// pem, pkcs12, jks.
+type certOutput struct {
+
+	// Format is the format of the file: "pem" for the private key followed
+	// by the certificate chain, "pkcs12" for a PKCS#12 file, or "jks" for a
+	// Java keystore
+	Format string `json:"format"`
+
+	// Alias is the alias of the private key in keystores. Defaults to "cert".
+	Alias string `json:"alias,omitempty"`
+
+	// Password is the secret holding the password of PKCS#12 files and
+	// keystores
+	Password *outputPassword `json:"password,omitempty"`
+
+	// Truststore is the destination of a Java keystore holding the CA
+	// certificates, for the "jks" format
+	Truststore *certParams `json:"truststore,omitempty"`
+
+	certParams
+}
+
+// outputPassword is the key of the Vault secret which holds a password.
+type outputPassword struct {
+	VaultPath string `json:"vault_path"`
+	Key       string `json:"key"`
+}
+
+// read reads the password from Vault.
+func (p *outputPassword) read(client *api.Logical) (string, error) {
+	secret, err := client.Read(p.VaultPath)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", fmt.Errorf("No secret found at path %s", p.VaultPath)
+	}
+	password, ok := secret.Data[p.Key].(string)
+	if !ok || password == "" {
+		return "", fmt.Errorf("No key %s found in secret %s", p.Key, p.VaultPath)
+	}
+	return password, nil
+}
+
+func (o *certOutput) defaultFile() (string, error) {
+	switch o.Format {
+	case pemOutput:
+		return "cert.pem", nil
+	case pkcs12Output:
+		return "cert.p12", nil
+	case jksOutput:
+		return "keystore.jks", nil
+	default:
+		return "", fmt.Errorf("Invalid output format %s. Must be one of: %s, %s, %s", o.Format, pemOutput, pkcs12Output, jksOutput)
+	}
+}
+
+// outputPaths returns the files written by each output.
+func (c *Certs) outputPaths(dest string) ([]string, error) {
+	var paths []string
+	for _, o := range c.Outputs {
+		defaultFile, err := o.defaultFile()
+		if err != nil {
+			return nil, err
+		}
+		file, _, err := c.getDestAndPerms(defaultFile, o.fileParameters, dest)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, file)
+		if o.Format == jksOutput && o.Truststore != nil {
+			file, _, err := c.getDestAndPerms(truststoreFile, o.Truststore.fileParameters, dest)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, file)
+		}
+	}
+	return paths, nil
+}
+
+// outputsExist reports whether every output has already been written.
+func (c *Certs) outputsExist(dest string) bool {
+	paths, err := c.outputPaths(dest)
+	if err != nil {
+		return false
+	}
+	for _, file := range paths {
+		if _, err := os.Stat(file); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCertificates parses every certificate in PEM encoded data.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// jksEntry is a certificate, trusted on its own or along with a private key.
+type jksEntry struct {
+	alias string
+	key   interface{}
+	chain []*x509.Certificate
+}
+
+// encodeJKS encodes the entries in a password protected JKS keystore.
+// Entries with a key are written as private key entries, and the rest as
+// trusted certificate entries.
+func encodeJKS(entries []*jksEntry, password string) ([]byte, error) {
+	ks := keystore.KeyStore{}
+	date := time.Now()
+	for _, entry := range entries {
+		// Aliases are case insensitive, and stored in lower case
+		alias := strings.ToLower(entry.alias)
+		if entry.key == nil {
+			ks[alias] = &keystore.TrustedCertificateEntry{
+				Entry:       keystore.Entry{CreationDate: date},
+				Certificate: keystore.Certificate{Type: jksCertType, Content: entry.chain[0].Raw},
+			}
+			continue
+		}
+		pkcs8, err := x509.MarshalPKCS8PrivateKey(entry.key)
+		if err != nil {
+			return nil, err
+		}
+		var chain []keystore.Certificate
+		for _, cert := range entry.chain {
+			chain = append(chain, keystore.Certificate{Type: jksCertType, Content: cert.Raw})
+		}
+		ks[alias] = &keystore.PrivateKeyEntry{
+			Entry:     keystore.Entry{CreationDate: date},
+			PrivKey:   pkcs8,
+			CertChain: chain,
+		}
+	}
+	var buf bytes.Buffer
+	if err := keystore.Encode(&buf, ks, []byte(password)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// outputs builds the files of every output, from the PEM encoded private key,
+// certificate chain (leaf first) and CA.
+func (c *Certs) outputs(client *api.Logical, keyData, chainData, caData []byte, dest string) ([]*fileContent, error) {
+	if len(c.Outputs) == 0 {
+		return nil, nil
+	}
+	key, err := parseKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse private key: %s", err)
+	}
+	chain, err := parseCertificates(chainData)
+	if err != nil || len(chain) == 0 {
+		return nil, fmt.Errorf("Unable to parse certificate chain: %v", err)
+	}
+	// The CA is usually the last certificate of the chain, if there is one
+	cas, err := parseCertificates(append(append([]byte{}, chainData...), caData...))
+	if err != nil {
+		return nil, err
+	}
+	var trusted []*x509.Certificate
+	for _, ca := range cas[1:] {
+		duplicated := false
+		for _, t := range trusted {
+			duplicated = duplicated || bytes.Equal(t.Raw, ca.Raw)
+		}
+		if !duplicated {
+			trusted = append(trusted, ca)
+		}
+	}
+
+	var files []*fileContent
+	for _, o := range c.Outputs {
+		defaultFile, err := o.defaultFile()
+		if err != nil {
+			return nil, err
+		}
+		file, perm, err := c.getDestAndPerms(defaultFile, withDefaultPerm(o.fileParameters, outputKeyPerm), dest)
+		if err != nil {
+			return nil, err
+		}
+		alias := o.Alias
+		if alias == "" {
+			alias = defaultAlias
+		}
+		password := ""
+		if o.Format != pemOutput {
+			if o.Password == nil {
+				return nil, fmt.Errorf("A password must be set for the %s output", o.Format)
+			}
+			if password, err = o.Password.read(client); err != nil {
+				return nil, err
+			}
+		}
+
+		var data []byte
+		switch o.Format {
+		case pemOutput:
+			data = append(append([]byte{}, keyData...), chainData...)
+		case pkcs12Output:
+			data, err = pkcs12.LegacyDES.Encode(key, chain[0], chain[1:], password)
+		case jksOutput:
+			data, err = encodeJKS([]*jksEntry{&jksEntry{alias: alias, key: key, chain: chain}}, password)
+			if err == nil && o.Truststore != nil {
+				var entries []*jksEntry
+				for i, ca := range trusted {
+					entries = append(entries, &jksEntry{alias: fmt.Sprintf("ca%d", i), chain: []*x509.Certificate{ca}})
+				}
+				truststore, perm, err := c.getDestAndPerms(truststoreFile, o.Truststore.fileParameters, dest)
+				if err != nil {
+					return nil, err
+				}
+				trustData, err := encodeJKS(entries, password)
+				if err != nil {
+					return nil, err
+				}
+				files = append(files, &fileContent{path: truststore, data: trustData, perm: perm})
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to encode the %s output: %s", o.Format, err)
+		}
+		files = append(files, &fileContent{path: file, data: data, perm: perm})
+	}
+	return files, nil
+}
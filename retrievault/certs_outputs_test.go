@@ -0,0 +1,174 @@
+package retrievault
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pavel-v-chernykh/keystore-go"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestEncodePKCS12(t *testing.T) {
+	ca, caKey, caPEM, _ := testCertificate(t, "ca", nil, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), nil, nil)
+	cert, _, certPEM, keyPEM := testCertificate(t, "web", []string{"web"}, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), ca, caKey)
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/generic/keystore": map[string]interface{}{
+			"data": map[string]interface{}{"password": "s3cr3t"},
+		},
+	})
+	defer stop()
+	c := &Certs{Outputs: []certOutput{
+		certOutput{Format: pkcs12Output, Password: &outputPassword{VaultPath: "generic/keystore", Key: "password"}},
+	}}
+	files, err := c.outputs(client.Logical(), keyPEM, append(append([]byte{}, certPEM...), caPEM...), nil, dir)
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+
+	key, leaf, cas, err := pkcs12.DecodeChain(files[0].data, "s3cr3t")
+	if err != nil {
+		t.Fatal("Expected a valid PKCS#12 file, got", err)
+	}
+	expectedKey, _ := parseKey(keyPEM)
+	if ecKey, ok := key.(*ecdsa.PrivateKey); !ok || !ecKey.PublicKey.Equal(expectedKey.Public()) {
+		t.Error("Expected the private key to be the one issued")
+	}
+	if !leaf.Equal(cert) || len(cas) != 1 || !cas[0].Equal(ca) {
+		t.Error("Expected the certificate chain", []string{"web", "ca"}, "got", leaf.Subject.CommonName, len(cas))
+	}
+
+	// The file must be readable by OpenSSL too
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not found")
+	}
+	p12 := path.Join(dir, "cert.p12")
+	ioutil.WriteFile(p12, files[0].data, 0600)
+	out, err := exec.Command("openssl", "pkcs12", "-in", p12, "-passin", "pass:s3cr3t", "-nodes").CombinedOutput()
+	if err != nil {
+		t.Fatal("Expected openssl to read the file, got", err, string(out))
+	}
+	if !bytes.Contains(out, []byte("subject=CN = web")) || !bytes.Contains(out, []byte("PRIVATE KEY")) {
+		t.Error("Expected openssl to print the certificate and the private key, got", string(out))
+	}
+}
+
+func TestEncodeJKS(t *testing.T) {
+	ca, caKey, _, _ := testCertificate(t, "ca", nil, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), nil, nil)
+	cert, _, _, keyPEM := testCertificate(t, "web", []string{"web"}, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), ca, caKey)
+	key, _ := parseKey(keyPEM)
+	data, err := encodeJKS([]*jksEntry{
+		&jksEntry{alias: "Web", key: key, chain: []*x509.Certificate{cert, ca}},
+		&jksEntry{alias: "ca0", chain: []*x509.Certificate{ca}},
+	}, "s3cr3t")
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+
+	if _, err := keystore.Decode(bytes.NewReader(data), []byte("wrong")); err == nil {
+		t.Error("Expected the integrity check to fail with a wrong password")
+	}
+	ks, err := keystore.Decode(bytes.NewReader(data), []byte("s3cr3t"))
+	if err != nil {
+		t.Fatal("Expected a valid keystore, got", err)
+	}
+	entry, ok := ks["web"].(*keystore.PrivateKeyEntry)
+	if !ok {
+		t.Fatal("Expected a private key entry with alias", "web", "got", ks)
+	}
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+	if !bytes.Equal(entry.PrivKey, pkcs8) {
+		t.Error("Expected the protected key to decrypt to the private key")
+	}
+	if len(entry.CertChain) != 2 || !bytes.Equal(entry.CertChain[0].Content, cert.Raw) || !bytes.Equal(entry.CertChain[1].Content, ca.Raw) {
+		t.Error("Expected the certificate chain of the private key entry")
+	}
+	trusted, ok := ks["ca0"].(*keystore.TrustedCertificateEntry)
+	if !ok || !bytes.Equal(trusted.Certificate.Content, ca.Raw) {
+		t.Error("Expected a trusted certificate entry with alias", "ca0")
+	}
+
+	// The keystore must be readable by keytool too
+	if _, err := exec.LookPath("keytool"); err != nil {
+		t.Skip("keytool not found")
+	}
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jks := path.Join(dir, "keystore.jks")
+	ioutil.WriteFile(jks, data, 0600)
+	out, err := exec.Command("keytool", "-list", "-keystore", jks, "-storepass", "s3cr3t").CombinedOutput()
+	if err != nil {
+		t.Fatal("Expected keytool to read the keystore, got", err, string(out))
+	}
+	if !bytes.Contains(out, []byte("web,")) || !bytes.Contains(out, []byte("PrivateKeyEntry")) || !bytes.Contains(out, []byte("trustedCertEntry")) {
+		t.Error("Expected keytool to list both entries, got", string(out))
+	}
+}
+
+func TestCertsOutputs(t *testing.T) {
+	ca, caKey, caPEM, _ := testCertificate(t, "ca", nil, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), nil, nil)
+	_, _, certPEM, keyPEM := testCertificate(t, "web", []string{"web"}, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), ca, caKey)
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/pki/issue/web": map[string]interface{}{
+			"data": map[string]interface{}{
+				"certificate": string(certPEM),
+				"private_key": string(keyPEM),
+				"issuing_ca":  string(caPEM),
+			},
+		},
+		"/v1/generic/keystore": map[string]interface{}{
+			"data": map[string]interface{}{"password": "s3cr3t"},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	password := &outputPassword{VaultPath: "generic/keystore", Key: "password"}
+	c := &Certs{CommonName: "web", Outputs: []certOutput{
+		certOutput{Format: pemOutput, certParams: certParams{fileParameters{Path: "haproxy.pem"}}},
+		certOutput{Format: pkcs12Output, Password: password},
+		certOutput{Format: jksOutput, Password: password, Truststore: &certParams{fileParameters{Perm: "0644"}}},
+	}}
+	e := make(chan error, 1)
+	c.FetchSecret(context.Background(), "pki/issue/web", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	perms := map[string]os.FileMode{
+		"haproxy.pem":    0600,
+		"cert.p12":       0600,
+		"keystore.jks":   0600,
+		"truststore.jks": 0644,
+	}
+	for file, perm := range perms {
+		fi, err := os.Stat(path.Join(dir, file))
+		if err != nil {
+			t.Error("For", file, "expected nil error", "got", err)
+		} else if fi.Mode().Perm() != perm {
+			t.Error("For", file, "expected", perm, "got", fi.Mode().Perm())
+		}
+	}
+	content, _ := ioutil.ReadFile(path.Join(dir, "haproxy.pem"))
+	if !bytes.HasPrefix(content, keyPEM) {
+		t.Error("Expected the PEM bundle to start with the private key")
+	}
+}
@@ -0,0 +1,168 @@
+package retrievault
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// parseCertificate parses the first certificate of a PEM file, which is the
+// leaf one when it holds a chain.
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("No certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// sortedNames returns names, without duplicates nor the excluded one, sorted.
+func sortedNames(names []string, exclude string) []string {
+	seen := map[string]bool{exclude: true}
+	result := []string{}
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// renewBefore returns how long before the end of its validity period the
+// given certificate must be renewed. Defaults to the last third of it.
+func (c *Certs) renewBefore(cert *x509.Certificate) (time.Duration, error) {
+	if c.RenewBefore != "" {
+		return time.ParseDuration(c.RenewBefore)
+	}
+	validity := cert.NotAfter.Sub(cert.NotBefore)
+	return time.Duration(float64(validity) * (1 - DefaultRenewFraction)), nil
+}
+
+// matches checks that cert was issued for the names requested.
+func (c *Certs) matches(cert *x509.Certificate) error {
+	if cert.Subject.CommonName != c.CommonName {
+		return fmt.Errorf("Common name changed from %s to %s", cert.Subject.CommonName, c.CommonName)
+	}
+	// The common name is usually added to the SANs by Vault, so it is
+	// ignored when comparing them
+	current := sortedNames(append(cert.DNSNames, cert.EmailAddresses...), c.CommonName)
+	requested := sortedNames(c.AltNames, c.CommonName)
+	if !reflect.DeepEqual(current, requested) {
+		return fmt.Errorf("Alt names changed from %s to %s", strings.Join(current, ","), strings.Join(requested, ","))
+	}
+	var currentIPs, requestedIPs []string
+	for _, ip := range cert.IPAddresses {
+		currentIPs = append(currentIPs, ip.String())
+	}
+	for _, ip := range c.IPSans {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			ip = parsed.String()
+		}
+		requestedIPs = append(requestedIPs, ip)
+	}
+	if !reflect.DeepEqual(sortedNames(currentIPs, ""), sortedNames(requestedIPs, "")) {
+		return fmt.Errorf("IP SANs changed from %s to %s", strings.Join(currentIPs, ","), strings.Join(requestedIPs, ","))
+	}
+	return nil
+}
+
+// matchesKey checks that the private key at keyFile belongs to cert.
+func matchesKey(cert *x509.Certificate, keyFile string) error {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	key, err := parseKey(data)
+	if err != nil {
+		return err
+	}
+	public, ok := key.Public().(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	if !ok || !public.Equal(cert.PublicKey) {
+		return fmt.Errorf("Private key %s doesn't match the certificate", keyFile)
+	}
+	return nil
+}
+
+// issuedByCurrentCA checks that cert was signed by the current CA of the PKI
+// backend where vaultPath is.
+func issuedByCurrentCA(client *api.Logical, vaultPath string, cert *x509.Certificate) error {
+	mount := strings.Trim(vaultPath, "/")
+	for _, endpoint := range []string{"/issue/", "/sign/"} {
+		if i := strings.LastIndex(mount, endpoint); i != -1 {
+			mount = mount[:i]
+			break
+		}
+	}
+	secret, err := client.Read(mount + "/cert/ca")
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return fmt.Errorf("No CA found at path %s/cert/ca", mount)
+	}
+	caData, _ := secret.Data["certificate"].(string)
+	ca, err := parseCertificate([]byte(caData))
+	if err != nil {
+		return fmt.Errorf("Unable to parse CA at path %s/cert/ca: %s", mount, err)
+	}
+	if err := cert.CheckSignatureFrom(ca); err != nil {
+		return fmt.Errorf("Certificate not issued by the current CA: %s", err)
+	}
+	return nil
+}
+
+// current returns the certificate at certFile if it can still be used: it
+// matches the names requested and the private key at keyFile, it was issued
+// by the current CA, and it isn't within its renewal window yet. Otherwise,
+// nil is returned and the reason is logged.
+func (c *Certs) current(client *api.Logical, vaultPath, certFile, keyFile string) *x509.Certificate {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil
+	}
+	logger := log.Msg.WithField("file", certFile)
+	cert, err := parseCertificate(data)
+	if err == nil {
+		err = c.matches(cert)
+	}
+	if err == nil {
+		err = matchesKey(cert, keyFile)
+	}
+	if err == nil {
+		err = issuedByCurrentCA(client, vaultPath, cert)
+	}
+	var renewAt time.Time
+	if err == nil {
+		var before time.Duration
+		if before, err = c.renewBefore(cert); err == nil {
+			renewAt = cert.NotAfter.Add(-before)
+			if !time.Now().Before(renewAt) {
+				err = fmt.Errorf("Certificate within its renewal window")
+			}
+		}
+	}
+	if err != nil {
+		logger.WithField("msg", err.Error()).Info("Issuing a new certificate")
+		return nil
+	}
+	logger.WithFields(logrus.Fields{
+		"not_after": cert.NotAfter.Format(time.RFC3339),
+		"renew_at":  renewAt.Format(time.RFC3339),
+	}).Info("Certificate still valid. Skipping...")
+	return cert
+}
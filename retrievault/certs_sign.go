@@ -0,0 +1,180 @@
+package retrievault
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	certsIssueMode = "issue"
+	certsSignMode  = "sign"
+	rsaKeyType     = "rsa"
+	ecKeyType      = "ec"
+	defaultRSABits = 2048
+	defaultECBits  = 256
+)
+
+// curves are the elliptic curves supported, by their size in bits.
+var curves = map[int]elliptic.Curve{
+	224: elliptic.P224(),
+	256: elliptic.P256(),
+	384: elliptic.P384(),
+	521: elliptic.P521(),
+}
+
+// generateKey generates a private key of the configured type and size, and
+// returns it along with its PEM encoding.
+func (c *Certs) generateKey() (crypto.Signer, []byte, error) {
+	keyType := c.KeyType
+	if keyType == "" {
+		keyType = rsaKeyType
+	}
+	log.Msg.WithFields(logrus.Fields{
+		"key_type": keyType,
+		"key_bits": c.KeyBits,
+	}).Info("Generating private key")
+	switch keyType {
+	case rsaKeyType:
+		bits := c.KeyBits
+		if bits == 0 {
+			bits = defaultRSABits
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}), nil
+	case ecKeyType:
+		bits := c.KeyBits
+		if bits == 0 {
+			bits = defaultECBits
+		}
+		curve, ok := curves[bits]
+		if !ok {
+			return nil, nil, fmt.Errorf("Invalid key bits %d for an EC key. Must be one of: 224, 256, 384, 521", bits)
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	default:
+		return nil, nil, fmt.Errorf("Invalid key type %s. Must be one of: %s, %s", keyType, rsaKeyType, ecKeyType)
+	}
+}
+
+// parseKey parses a PEM encoded private key, either in PKCS#1, SEC 1 or
+// PKCS#8 format.
+func parseKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported private key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block type %s", block.Type)
+	}
+}
+
+// privateKey returns the private key at keyFile, along with its PEM
+// encoding, or a new one if the file doesn't exist or the certificate is
+// kept in memory.
+func (c *Certs) privateKey(keyFile string) (crypto.Signer, []byte, error) {
+	if c.inMemory() {
+		return c.generateKey()
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		return c.generateKey()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parseKey(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to parse private key %s: %s", keyFile, err)
+	}
+	log.Msg.WithField("file", keyFile).Debug("Reusing existing private key")
+	return key, data, nil
+}
+
+// csr builds a PEM encoded certificate signing request for the configured
+// names, signed with key.
+func (c *Certs) csr(key crypto.Signer) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: c.CommonName},
+	}
+	for _, name := range c.AltNames {
+		if strings.Contains(name, "@") {
+			template.EmailAddresses = append(template.EmailAddresses, name)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	for _, ip := range c.IPSans {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return nil, fmt.Errorf("Invalid IP SAN %s", ip)
+		}
+		template.IPAddresses = append(template.IPAddresses, parsed)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// sign sends a CSR for the private key at keyFile, which is generated if it
+// doesn't exist, to be signed at vaultPath. The PEM encoded key is returned
+// along with the certificate issued.
+func (c *Certs) sign(client *api.Logical, vaultPath, keyFile string) (*api.Secret, []byte, error) {
+	key, keyData, err := c.privateKey(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := c.csr(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := c.request()
+	data["csr"] = string(csr)
+	secret, err := client.Write(vaultPath, data)
+	return secret, keyData, err
+}
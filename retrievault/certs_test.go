@@ -0,0 +1,167 @@
+package retrievault
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// testCertificate issues a certificate for the given names, valid between
+// notBefore and notAfter, and returns it along with its PEM encoded key. It
+// is self-signed if parent is nil.
+func testCertificate(t *testing.T, cn string, dnsNames []string, notBefore, notAfter time.Time, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.ParseIP("10.0.0.1")},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestCertsSign(t *testing.T) {
+	client, requests, stop := testVault(t, map[string]interface{}{
+		"/v1/pki/sign/web": map[string]interface{}{
+			"data": map[string]interface{}{
+				"certificate": "cert",
+				"issuing_ca":  "ca",
+				"ca_chain":    []interface{}{"intermediate"},
+			},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Certs{
+		CommonName: "web.example.com",
+		AltNames:   []string{"www.example.com"},
+		IPSans:     []string{"10.0.0.1"},
+		Mode:       certsSignMode,
+		KeyType:    ecKeyType,
+	}
+	e := make(chan error, 1)
+	c.FetchSecret(context.Background(), "pki/sign/web", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	key, err := ioutil.ReadFile(path.Join(dir, "cert.key"))
+	if err != nil {
+		t.Fatal("Expected a private key, got", err)
+	}
+	parsed, err := parseKey(key)
+	if err != nil {
+		t.Fatal("Expected a valid private key, got", err)
+	}
+	if _, ok := parsed.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("Expected an EC private key, got %T", parsed)
+	}
+	block, _ := pem.Decode([]byte((*requests)[0].body["csr"].(string)))
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal("Expected a valid CSR, got", err)
+	}
+	if csr.Subject.CommonName != "web.example.com" || len(csr.DNSNames) != 1 || len(csr.IPAddresses) != 1 {
+		t.Error("Expected a CSR for the names requested, got", csr.Subject.CommonName, csr.DNSNames, csr.IPAddresses)
+	}
+	content, _ := ioutil.ReadFile(path.Join(dir, "cert.crt"))
+	if string(content) != "cert\nintermediate\n" {
+		t.Error("Expected", "cert\nintermediate\n", "got", string(content))
+	}
+
+	// The private key is kept when signing again
+	c.FetchSecret(context.Background(), "pki/sign/web", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if again, _ := ioutil.ReadFile(path.Join(dir, "cert.key")); !bytes.Equal(key, again) {
+		t.Error("Expected the private key to be reused")
+	}
+}
+
+type testcertrenewal struct {
+	altNames  []string
+	notBefore time.Time
+	notAfter  time.Time
+	issued    bool
+}
+
+var testcertrenewals = []*testcertrenewal{
+	&testcertrenewal{[]string{"www.example.com"}, time.Now().Add(-time.Hour), time.Now().Add(90 * 24 * time.Hour), false},
+	&testcertrenewal{[]string{"www.example.com", "api.example.com"}, time.Now().Add(-time.Hour), time.Now().Add(90 * 24 * time.Hour), true},
+	&testcertrenewal{[]string{"www.example.com"}, time.Now().Add(-80 * 24 * time.Hour), time.Now().Add(10 * 24 * time.Hour), true},
+}
+
+func TestCertsSkipValidCertificate(t *testing.T) {
+	ca, caKey, caPEM, _ := testCertificate(t, "ca", nil, time.Now().Add(-time.Hour), time.Now().Add(365*24*time.Hour), nil, nil)
+	client, requests, stop := testVault(t, map[string]interface{}{
+		"/v1/pki/cert/ca": map[string]interface{}{
+			"data": map[string]interface{}{"certificate": string(caPEM)},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, pair := range testcertrenewals {
+		_, _, certPEM, keyPEM := testCertificate(t, "web.example.com", []string{"web.example.com", "www.example.com"}, pair.notBefore, pair.notAfter, ca, caKey)
+		ioutil.WriteFile(path.Join(dir, "cert.crt"), certPEM, 0644)
+		ioutil.WriteFile(path.Join(dir, "cert.key"), keyPEM, 0600)
+		*requests = nil
+
+		c := &Certs{CommonName: "web.example.com", AltNames: pair.altNames, IPSans: []string{"10.0.0.1"}}
+		e := make(chan error, 1)
+		c.FetchSecret(context.Background(), "pki/issue/web", dir, client.Logical(), e)
+		err := <-e
+		issued := false
+		for _, req := range *requests {
+			if req.path == "/v1/pki/issue/web" {
+				issued = true
+			}
+		}
+		if issued != pair.issued {
+			t.Error("For", pair.altNames, pair.notAfter, "expected issued", pair.issued, "got", issued)
+		}
+		if !pair.issued && (err != nil || c.Lease() == nil || c.Lease().LeaseDuration <= 0) {
+			t.Error("For", pair.altNames, pair.notAfter, "expected a lease until the certificate expires, got", c.Lease(), err)
+		}
+	}
+}
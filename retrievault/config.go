@@ -0,0 +1,379 @@
+package retrievault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/hcl/ast"
+	hclparser "github.com/hashicorp/hcl/hcl/parser"
+	hcltoken "github.com/hashicorp/hcl/hcl/token"
+	"gopkg.in/yaml.v2"
+)
+
+// yamlLine extracts the line number from the errors of the YAML parser.
+var yamlLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// LoadConfig reads the configuration file at path, and the secrets of the
+// files its Include globs match. The format of each file is detected by its
+// extension: ".yaml" or ".yml" for YAML, ".hcl" for HCL, and JSON otherwise.
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	content, converted, err := readConfigFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := decodeConfig(path, content, converted, &config, false); err != nil {
+		return config, err
+	}
+
+	for _, pattern := range config.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return config, fmt.Errorf("%s: invalid include %s: %s", path, pattern, err)
+		}
+		for _, file := range files {
+			var included struct {
+				Secrets []*Secret `json:"secrets"`
+			}
+			content, converted, err := readConfigFile(file)
+			if err != nil {
+				return config, err
+			}
+			if err := decodeConfig(file, content, converted, &included, true); err != nil {
+				return config, err
+			}
+			config.Secrets = append(config.Secrets, included.Secrets...)
+		}
+	}
+	return config, nil
+}
+
+// readConfigFile reads a configuration file, and converts it to JSON if it is
+// written in another format, reporting whether it did.
+func readConfigFile(path string) ([]byte, bool, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	var value interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		value, err = parseYAML(path, content)
+	case ".hcl":
+		value, err = parseHCL(path, content)
+	default:
+		return content, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if err := octalPerms(value); err != nil {
+		return nil, false, fmt.Errorf("%s: %s", path, err)
+	}
+	content, err = json.Marshal(value)
+	return content, true, err
+}
+
+// decodeConfig decodes the JSON content of the configuration file at path
+// into v. Errors are reported with their line and column, unless content was
+// converted from another format, and with the field they refer to. If strict
+// is set, unknown fields are rejected.
+func decodeConfig(path string, content []byte, converted bool, v interface{}, strict bool) error {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(v)
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *json.SyntaxError:
+		line, column := position(content, e.Offset)
+		return fmt.Errorf("%s:%d:%d: %s", path, line, column, e)
+	case *json.UnmarshalTypeError:
+		if converted {
+			return fmt.Errorf("%s: invalid value for %s: expected %s, got %s", path, e.Field, e.Type, e.Value)
+		}
+		line, column := position(content, e.Offset)
+		return fmt.Errorf("%s:%d:%d: invalid value for %s: expected %s, got %s", path, line, column, e.Field, e.Type, e.Value)
+	default:
+		return fmt.Errorf("%s: %s", path, err)
+	}
+}
+
+// position returns the line and column of the last byte read by the JSON
+// decoder when it failed, after reading offset bytes of content.
+func position(content []byte, offset int64) (int, int) {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	if offset > 0 {
+		offset--
+	}
+	before := content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// parseYAML parses a YAML document into the values json.Marshal expects.
+func parseYAML(path string, content []byte) (interface{}, error) {
+	var node yamlNode
+	if err := yaml.Unmarshal(content, &node); err != nil {
+		if m := yamlLine.FindStringSubmatch(err.Error()); m != nil {
+			return nil, fmt.Errorf("%s:%s: %s", path, m[1], m[2])
+		}
+		return nil, fmt.Errorf("%s: %s", path, strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	return yamlValue(node.value)
+}
+
+// yamlNode is a YAML value decoded as yaml.Unmarshal does into an
+// interface{}, except for the integers written in octal, which are kept as
+// octalNumber.
+type yamlNode struct {
+	value interface{}
+}
+
+func (n *yamlNode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var m map[interface{}]yamlNode
+	if err := unmarshal(&m); err == nil && m != nil {
+		v := make(map[interface{}]interface{}, len(m))
+		for key, item := range m {
+			v[key] = item.value
+		}
+		n.value = v
+		return nil
+	}
+	var list []yamlNode
+	if err := unmarshal(&list); err == nil && list != nil {
+		v := make([]interface{}, len(list))
+		for i, item := range list {
+			v[i] = item.value
+		}
+		n.value = v
+		return nil
+	}
+	if err := unmarshal(&n.value); err != nil {
+		return err
+	}
+	// Scalars are decoded into strings as they are written
+	var text string
+	if i, ok := n.value.(int); ok && unmarshal(&text) == nil && isOctal(text) {
+		n.value = octalNumber(i)
+	}
+	return nil
+}
+
+// yamlValue converts the maps of a YAML document, which may have keys of any
+// type, to maps with string keys.
+func yamlValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("Invalid key %v: keys must be strings", key)
+			}
+			converted, err := yamlValue(item)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = converted
+		}
+		return m, nil
+	case []interface{}:
+		for i, item := range v {
+			converted, err := yamlValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+		return v, nil
+	default:
+		return value, nil
+	}
+}
+
+// parseHCL parses an HCL document into the values json.Marshal expects.
+// Objects are written either as blocks or assigned, and a block repeated in
+// the same object makes a list, so that each secret can be written as its own
+// "secrets" block.
+func parseHCL(path string, content []byte) (interface{}, error) {
+	file, err := hclparser.Parse(content)
+	if err != nil {
+		if e, ok := err.(*hclparser.PosError); ok {
+			return nil, fmt.Errorf("%s:%d:%d: %s", path, e.Pos.Line, e.Pos.Column, e.Err)
+		}
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	root, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("%s: the configuration must be an object", path)
+	}
+	value, err := hclObject(path, root)
+	if err != nil {
+		return nil, err
+	}
+	if secrets, ok := value["secrets"].(map[string]interface{}); ok {
+		value["secrets"] = []interface{}{secrets}
+	}
+	return value, nil
+}
+
+// hclObject converts the items of an HCL object. Labeled blocks with the same
+// key, like `keys "a" {}` and `keys "b" {}`, are merged into one object, and
+// repeated "secrets" blocks make a list.
+func hclObject(path string, list *ast.ObjectList) (map[string]interface{}, error) {
+	const (
+		assigned = iota
+		unlabeled
+		labeled
+	)
+	object := make(map[string]interface{})
+	kinds := make(map[string]int)
+	for _, item := range list.Items {
+		value, err := hclValue(path, item.Val)
+		if err != nil {
+			return nil, err
+		}
+		// Blocks with several keys, like `a "b" {}`, are nested objects
+		for i := len(item.Keys) - 1; i > 0; i-- {
+			value = map[string]interface{}{hclKey(item.Keys[i]): value}
+		}
+		key := hclKey(item.Keys[0])
+		kind := assigned
+		if _, isObject := value.(map[string]interface{}); isObject && !item.Assign.IsValid() {
+			kind = unlabeled
+			if len(item.Keys) > 1 {
+				kind = labeled
+			}
+		}
+		current, exists := object[key]
+		pos := item.Keys[0].Pos()
+		switch {
+		case !exists:
+			object[key] = value
+			kinds[key] = kind
+		case kind == labeled && kinds[key] == labeled:
+			if name, ok := mergeLabels(current.(map[string]interface{}), value.(map[string]interface{}), len(item.Keys)-1); !ok {
+				return nil, fmt.Errorf("%s:%d:%d: %s %s set more than once", path, pos.Line, pos.Column, key, name)
+			}
+		case kind == unlabeled && kinds[key] == unlabeled && key == "secrets":
+			if list, ok := current.([]interface{}); ok {
+				object[key] = append(list, value)
+			} else {
+				object[key] = []interface{}{current, value}
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d:%d: %s set more than once", path, pos.Line, pos.Column, key)
+		}
+	}
+	return object, nil
+}
+
+// mergeLabels merges the labels of a block into those of the previous blocks
+// with the same key, down to depth labels. If a block with the same labels
+// already exists, its labels are returned and false.
+func mergeLabels(dst, src map[string]interface{}, depth int) (string, bool) {
+	for label, value := range src {
+		current, exists := dst[label]
+		if !exists {
+			dst[label] = value
+			continue
+		}
+		currentObject, ok := current.(map[string]interface{})
+		if depth <= 1 || !ok {
+			return strconv.Quote(label), false
+		}
+		if name, ok := mergeLabels(currentObject, value.(map[string]interface{}), depth-1); !ok {
+			return strconv.Quote(label) + " " + name, false
+		}
+	}
+	return "", true
+}
+
+func hclKey(key *ast.ObjectKey) string {
+	return fmt.Sprint(key.Token.Value())
+}
+
+// hclValue converts an HCL value.
+func hclValue(path string, node ast.Node) (interface{}, error) {
+	switch n := node.(type) {
+	case *ast.LiteralType:
+		if n.Token.Type == hcltoken.NUMBER && isOctal(n.Token.Text) {
+			if i, ok := n.Token.Value().(int64); ok {
+				return octalNumber(i), nil
+			}
+		}
+		return n.Token.Value(), nil
+	case *ast.ListType:
+		list := make([]interface{}, 0, len(n.List))
+		for _, item := range n.List {
+			value, err := hclValue(path, item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case *ast.ObjectType:
+		return hclObject(path, n.List)
+	default:
+		pos := node.Pos()
+		return nil, fmt.Errorf("%s:%d:%d: unsupported value", path, pos.Line, pos.Column)
+	}
+}
+
+// octalNumber is an integer written in octal, like 0600.
+type octalNumber int64
+
+// isOctal reports whether a number is written in octal, like 0600 or 0o600.
+func isOctal(text string) bool {
+	text = strings.TrimLeft(text, "+-")
+	if strings.HasPrefix(text, "0o") || strings.HasPrefix(text, "0O") {
+		return true
+	}
+	return len(text) > 1 && text[0] == '0' && text[1] >= '0' && text[1] <= '7'
+}
+
+// octalPerms converts the numbers set as "perm", which YAML and HCL parse as
+// octal when they are written like 0600, to the strings expected. Other
+// numbers are rejected, as 600 would be read as decimal.
+func octalPerms(value interface{}) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if key != "perm" {
+				if err := octalPerms(item); err != nil {
+					return err
+				}
+				continue
+			}
+			switch n := item.(type) {
+			case octalNumber:
+				v[key] = fmt.Sprintf("%04o", n)
+			case int, int64:
+				return fmt.Errorf("invalid perm %v: must be written in octal, like 0%v, or as a string, like \"0%v\"", n, n, n)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := octalPerms(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package retrievault
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testconfigfiles = map[string]string{
+	"config.json": `{
+  "vault_addr": "https://vault:8200",
+  "include": ["conf.d/*"],
+  "secrets": [
+    {
+      "type": "generic",
+      "path": "/etc/app",
+      "vault_path": "secret/app",
+      "parameters": {"keys": {"password": {"path": "db", "perm": "0600"}}}
+    }
+  ]
+}`,
+	"config.yaml": `# Vault server
+vault_addr: https://vault:8200
+include:
+  - conf.d/*
+secrets:
+  - type: generic
+    path: /etc/app
+    vault_path: secret/app
+    parameters:
+      keys:
+        password:
+          path: db
+          perm: 0600
+`,
+	"config.yml": `vault_addr: https://vault:8200
+include: [conf.d/*]
+secrets:
+  - {type: generic, path: /etc/app, vault_path: secret/app, parameters: {keys: {password: {path: db, perm: 0o600}}}}
+`,
+	"config.hcl": `# Vault server
+vault_addr = "https://vault:8200"
+include = ["conf.d/*"]
+
+secrets {
+  type = "generic"
+  path = "/etc/app"
+  vault_path = "secret/app"
+  parameters {
+    keys "password" {
+      path = "db"
+      perm = 0600
+    }
+    keys "user" {
+      path = "db_user"
+    }
+  }
+}
+`,
+}
+
+var testincludedfiles = map[string]string{
+	"conf.d/a.yml":  "secrets:\n  - type: kv2\n    vault_path: secret/data/a\n",
+	"conf.d/b.hcl":  "secrets {\n  type = \"generic\"\n  vault_path = \"secret/b\"\n}\nsecrets {\n  type = \"generic\"\n  vault_path = \"secret/c\"\n}\n",
+	"conf.d/c.json": `{"secrets": [{"type": "generic", "vault_path": "secret/d"}]}`,
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		file := path.Join(dir, name)
+		os.MkdirAll(path.Dir(file), 0700)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, testconfigfiles)
+	writeTestFiles(t, dir, testincludedfiles)
+
+	expected := []string{"secret/app", "secret/data/a", "secret/b", "secret/c", "secret/d"}
+	for name := range testconfigfiles {
+		config, err := LoadConfig(path.Join(dir, name))
+		if err != nil {
+			t.Error("For", name, "expected nil error, got", err)
+			continue
+		}
+		if config.VaultAddr != "https://vault:8200" {
+			t.Error("For", name, "expected", "https://vault:8200", "got", config.VaultAddr)
+		}
+		var vaultPaths []string
+		for _, secret := range config.Secrets {
+			vaultPaths = append(vaultPaths, secret.VaultPath)
+		}
+		if !reflect.DeepEqual(vaultPaths, expected) {
+			t.Error("For", name, "expected", expected, "got", vaultPaths)
+			continue
+		}
+		var parameters interface{}
+		json.Unmarshal(config.Secrets[0].Parameters, &parameters)
+		expectedParameters := map[string]interface{}{
+			"keys": map[string]interface{}{"password": map[string]interface{}{"path": "db", "perm": "0600"}},
+		}
+		if name == "config.hcl" {
+			// Labeled blocks with the same name are merged
+			expectedParameters["keys"].(map[string]interface{})["user"] = map[string]interface{}{"path": "db_user"}
+		}
+		if !reflect.DeepEqual(parameters, expectedParameters) {
+			t.Error("For", name, "expected", expectedParameters, "got", parameters)
+		}
+	}
+}
+
+type testconfigerror struct {
+	name     string
+	content  string
+	expected string
+}
+
+var testconfigerrors = []*testconfigerror{
+	&testconfigerror{"config.json", "{\n  \"vault_addr\": \"https://vault:8200\"\n  \"secrets\": []\n}", "config.json:3:3: invalid character"},
+	&testconfigerror{"config.json", "{\n  \"secrets\": [\n    {\"type\": 1}\n  ]\n}", "config.json:3:14: invalid value for secrets"},
+	&testconfigerror{"config.yaml", "secrets:\n  - type: generic\n   vault_path: secret/app\n", "config.yaml:2: did not find expected"},
+	&testconfigerror{"config.yaml", "secrets:\n  - type: [generic]\n", "config.yaml: invalid value for secrets"},
+	&testconfigerror{"config.hcl", "vault_addr = \"https://vault:8200\"\nsecrets {\n  type = \n}\n", "config.hcl:5:1: "},
+	&testconfigerror{"config.hcl", "vault_addr = \"a\"\nvault_addr = \"b\"\n", "config.hcl:2:1: vault_addr set more than once"},
+	&testconfigerror{"config.hcl", "secrets {\n  parameters {\n    keys \"a\" {}\n    keys \"a\" {}\n  }\n}\n", "config.hcl:4:5: keys \"a\" set more than once"},
+	&testconfigerror{"config.json", `{"include": ["conf.d/*.json"]}`, "extra.json: json: unknown field"},
+	&testconfigerror{"config.yaml", "secrets:\n  - type: generic\n    parameters: {perm: 644}\n", "config.yaml: invalid perm 644: must be written in octal, like 0644"},
+	&testconfigerror{"config.hcl", "secrets {\n  type = \"generic\"\n  parameters { perm = 644 }\n}\n", "config.hcl: invalid perm 644: must be written in octal, like 0644"},
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Included files can only hold secrets
+	writeTestFiles(t, dir, map[string]string{"conf.d/extra.json": `{"vault_addr": "https://vault:8200"}`})
+
+	for _, test := range testconfigerrors {
+		file := path.Join(dir, test.name)
+		writeTestFiles(t, dir, map[string]string{test.name: test.content})
+		_, err := LoadConfig(file)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Error("For", test.content, "expected", test.expected, "got", err)
+		}
+	}
+}
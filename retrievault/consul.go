@@ -0,0 +1,116 @@
+package retrievault
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	consulTokenFormat = "token"
+	consulEnvFormat   = "env"
+)
+
+// Consul fetches an ACL token from the Consul backend, reading it from the
+// "consul/creds/<role>" path, and writes it either alone, as read by the
+// -token-file flag of Consul agents, or as the environment variable of the
+// Consul CLI.
+type Consul struct {
+
+	// Format is the format of the file written: "token" for the token alone,
+	// or "env" for the CONSUL_HTTP_TOKEN environment variable. Defaults to
+	// "token".
+	Format string `json:"format,omitempty"`
+
+	// Revoke revokes the lease of the token when the daemon stops
+	Revoke bool `json:"revoke_on_shutdown,omitempty"`
+
+	fileParameters
+	secret *api.Secret
+	writer
+}
+
+func NewConsul() *Consul {
+	return new(Consul)
+}
+
+// Lease returns the last token fetched.
+func (c *Consul) Lease() *api.Secret {
+	return c.secret
+}
+
+// RevokeOnShutdown reports whether the lease of the token must be revoked
+// when the daemon stops.
+func (c *Consul) RevokeOnShutdown() bool {
+	return c.Revoke
+}
+
+func (c *Consul) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
+	format := c.Format
+	if format == "" {
+		format = consulTokenFormat
+	}
+	if format != consulTokenFormat && format != consulEnvFormat {
+		e <- fmt.Errorf("Invalid format %s for Consul tokens. Must be one of: %s, %s", format, consulTokenFormat, consulEnvFormat)
+		return
+	}
+	defaultFile := "token"
+	if format == consulEnvFormat {
+		defaultFile = "consul.env"
+	}
+	file, perm, err := c.getDestAndPerms(defaultFile, c.fileParameters, dest)
+	if err != nil {
+		log.Msg.WithFields(logrus.Fields{
+			"format":      format,
+			"permissions": perm,
+		}).Error(err.Error())
+		e <- err
+		return
+	}
+
+	log.Msg.WithField("vault_path", vaultPath).Debug("Fetching secret at path")
+	secret, err := client.Read(vaultPath)
+	if err != nil {
+		e <- err
+		return
+	}
+	if secret == nil {
+		e <- fmt.Errorf("No token found at path %s", vaultPath)
+		return
+	}
+	c.secret = secret
+	token, _ := secret.Data["token"].(string)
+	if token == "" {
+		e <- fmt.Errorf("No token found at path %s", vaultPath)
+		return
+	}
+	log.Msg.WithFields(logrus.Fields{
+		"vault_path": vaultPath,
+		"lease_id":   secret.LeaseID,
+	}).Info("Consul token issued")
+
+	data := []byte(token)
+	if format == consulEnvFormat {
+		data = []byte(fmt.Sprintf("CONSUL_HTTP_TOKEN=%s\n", token))
+	}
+
+	er := make(chan error, 1)
+	go c.writeInFile(file, data, perm, er)
+	select {
+	case <-ctx.Done():
+		log.Msg.Error("Parent context cancelled")
+		e <- ctx.Err()
+		return
+	case err := <-er:
+		if err != nil {
+			log.Msg.Error("Error when writing secret to file")
+			e <- err
+			return
+		}
+	}
+	e <- nil
+	return
+}
@@ -0,0 +1,60 @@
+package retrievault
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type testconsul struct {
+	format   string
+	file     string
+	expected string
+}
+
+var testconsuls = []*testconsul{
+	&testconsul{"", "token", "b7b2f4c1-token"},
+	&testconsul{"env", "consul.env", "CONSUL_HTTP_TOKEN=b7b2f4c1-token\n"},
+}
+
+func TestConsulFetchSecret(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/consul/creds/agent": map[string]interface{}{
+			"lease_id":       "consul/creds/agent/1234",
+			"lease_duration": 3600,
+			"data":           map[string]interface{}{"token": "b7b2f4c1-token"},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range testconsuls {
+		c := &Consul{Format: test.format}
+		e := make(chan error, 1)
+		c.FetchSecret(context.Background(), "consul/creds/agent", dir, client.Logical(), e)
+		if err := <-e; err != nil {
+			t.Error("For", test.format, "expected nil error, got", err)
+			continue
+		}
+		content, _ := ioutil.ReadFile(path.Join(dir, test.file))
+		if string(content) != test.expected {
+			t.Error("For", test.format, "expected", test.expected, "got", string(content))
+		}
+		if lease := c.Lease(); lease == nil || lease.LeaseID != "consul/creds/agent/1234" {
+			t.Error("For", test.format, "expected lease", "consul/creds/agent/1234", "got", lease)
+		}
+	}
+
+	c := &Consul{Format: "json"}
+	e := make(chan error, 1)
+	c.FetchSecret(context.Background(), "consul/creds/agent", dir, client.Logical(), e)
+	if err := <-e; err == nil {
+		t.Error("For", c.Format, "expected error, got nil")
+	}
+}
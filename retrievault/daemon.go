@@ -0,0 +1,250 @@
+package retrievault
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// retryInterval is the time to wait before trying again to fetch a secret
+// whose last fetch failed.
+const retryInterval = 30 * time.Second
+
+// Daemon fetches all the secrets and keeps them up to date until ctx is
+// cancelled. Renewable leases are renewed through Vault, and secrets that
+// can't be renewed are fetched again, once RenewFraction of their lease
+// duration has passed. Each fetch is bounded by timeout.
+func (r *RetrieVault) Daemon(ctx context.Context, timeout time.Duration) error {
+	wait, err := r.startDaemon(ctx, timeout)
+	if err != nil {
+		return err
+	}
+	wait()
+	return nil
+}
+
+// startDaemon fetches all the secrets, and starts keeping them up to date in
+// the background until ctx is cancelled. The function returned waits until
+// it has stopped.
+func (r *RetrieVault) startDaemon(ctx context.Context, timeout time.Duration) (func(), error) {
+	fraction, err := r.renewFraction()
+	if err != nil {
+		return nil, err
+	}
+	interval, err := r.refreshInterval()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.inMemory {
+		return nil, fmt.Errorf("The daemon mode can't keep secrets in memory")
+	}
+
+	fetchCtx, cancel := context.WithTimeout(ctx, timeout)
+	_, retrievers, err := r.fetch(fetchCtx, ctx, true)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	log.Msg.Info("All secrets fetched successfully!")
+
+	var wg sync.WaitGroup
+	for _, id := range r.distinctIdentities() {
+		tokens := id.tokens
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens.run(ctx, fraction)
+		}()
+	}
+	for i, secret := range r.Secrets {
+		w := &watcher{
+			secret:   secret,
+			retr:     retrievers[i],
+			fraction: fraction,
+			interval: interval,
+			timeout:  timeout,
+			rvault:   r,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.watch(ctx)
+		}()
+	}
+	return wg.Wait, nil
+}
+
+// renewFraction returns the configured RenewFraction, or the default one if
+// it is not set.
+func (r *RetrieVault) renewFraction() (float64, error) {
+	if r.RenewFraction == 0 {
+		return DefaultRenewFraction, nil
+	}
+	if r.RenewFraction < 0 || r.RenewFraction >= 1 {
+		return 0, fmt.Errorf("Invalid renew fraction %v. Must be greater than 0 and lower than 1", r.RenewFraction)
+	}
+	return r.RenewFraction, nil
+}
+
+// refreshInterval returns the configured RefreshInterval, or the default one
+// if it is not set.
+func (r *RetrieVault) refreshInterval() (time.Duration, error) {
+	interval := r.RefreshInterval
+	if interval == "" {
+		interval = DefaultRefreshInterval
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("Invalid refresh interval %s. Must be greater than 0", interval)
+	}
+	return d, nil
+}
+
+// watcher keeps a single secret up to date.
+type watcher struct {
+	secret   *Secret
+	retr     Retriever
+	fraction float64
+	interval time.Duration
+	timeout  time.Duration
+	rvault   *RetrieVault
+}
+
+func (w *watcher) log() *logrus.Entry {
+	return log.Msg.WithFields(logrus.Fields{
+		"secret_type": w.secret.Type,
+		"vault_path":  w.secret.VaultPath,
+	})
+}
+
+// lease returns the last secret fetched by the retriever, if any.
+func (w *watcher) lease() *api.Secret {
+	if leaser, ok := w.retr.(Leaser); ok {
+		return leaser.Lease()
+	}
+	return nil
+}
+
+// next returns the time to wait before the given lease must be renewed.
+func (w *watcher) next(lease *api.Secret) time.Duration {
+	if lease == nil || lease.LeaseDuration <= 0 {
+		return w.interval
+	}
+	return time.Duration(float64(lease.LeaseDuration)*w.fraction) * time.Second
+}
+
+func (w *watcher) watch(ctx context.Context) {
+	lease := w.lease()
+	wait := w.next(lease)
+	for {
+		w.log().WithField("wait", wait.String()).Debug("Scheduling secret refresh")
+		select {
+		case <-ctx.Done():
+			w.revoke(lease)
+			return
+		case <-time.After(wait):
+		}
+
+		if lease != nil && lease.Renewable && lease.LeaseID != "" {
+			renewed, err := w.renew(lease)
+			if err == nil {
+				wait = w.next(renewed)
+				continue
+			}
+			w.log().WithField("msg", err.Error()).Info("Unable to renew lease. Fetching secret again")
+		}
+
+		if err := w.fetch(ctx); err != nil {
+			w.log().WithField("msg", err.Error()).Error("Error when fetching secret. Retrying later")
+			wait = retryInterval
+			continue
+		}
+		lease = w.lease()
+		wait = w.next(lease)
+	}
+}
+
+// revoke revokes the given lease if the retriever asks for it, once the daemon
+// is stopping.
+func (w *watcher) revoke(lease *api.Secret) {
+	revoker, ok := w.retr.(Revoker)
+	if !ok || !revoker.RevokeOnShutdown() || lease == nil || lease.LeaseID == "" {
+		return
+	}
+	var err error
+	w.rvault.identityOf(w.secret).use(func(client *api.Client) {
+		err = client.Sys().Revoke(lease.LeaseID)
+	})
+	if err != nil {
+		w.log().WithFields(logrus.Fields{
+			"msg":      err.Error(),
+			"lease_id": lease.LeaseID,
+		}).Error("Unable to revoke lease")
+		return
+	}
+	w.log().WithField("lease_id", lease.LeaseID).Info("Lease revoked")
+}
+
+// renew renews the lease of the given secret. An error is returned if the
+// lease can't be renewed for, at least, its original duration, as that means
+// that it is close to its maximum TTL and the secret has to be fetched again.
+func (w *watcher) renew(lease *api.Secret) (*api.Secret, error) {
+	w.log().WithField("lease_id", lease.LeaseID).Debug("Renewing lease")
+	var (
+		renewed *api.Secret
+		err     error
+	)
+	w.rvault.identityOf(w.secret).use(func(client *api.Client) {
+		renewed, err = client.Sys().Renew(lease.LeaseID, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if renewed == nil || renewed.LeaseDuration < lease.LeaseDuration {
+		return nil, fmt.Errorf("Lease %s is reaching its maximum TTL", lease.LeaseID)
+	}
+	return renewed, nil
+}
+
+// fetch fetches the secret again with a new retriever, which replaces the
+// previous one only if everything went fine. The hook of the secret is run
+// after the fetch, so it is only bounded by its own timeout and by ctx. The
+// lease of the previous secret is revoked once the hook has run, as nothing
+// uses it anymore.
+func (w *watcher) fetch(ctx context.Context) error {
+	retr, err := w.rvault.newRetriever(w.secret)
+	if err != nil {
+		return err
+	}
+	fetchCtx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	e := make(chan error, 1)
+	w.log().Info("Fetching secret")
+	go w.rvault.fetchSecret(fetchCtx, w.secret, retr, e)
+	select {
+	case <-fetchCtx.Done():
+		return fetchCtx.Err()
+	case err := <-e:
+		if err != nil {
+			return err
+		}
+	}
+	cancel()
+	previous := w.lease()
+	w.retr = retr
+	w.log().Info("Secret fetched successfully")
+	w.rvault.runHook(ctx, w.secret, retr)
+	if lease := w.lease(); previous != nil && (lease == nil || lease.LeaseID != previous.LeaseID) {
+		w.revoke(previous)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package retrievault
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+type testfraction struct {
+	value    float64
+	expected float64
+	e        bool
+}
+
+var testfractions = []*testfraction{
+	&testfraction{0, DefaultRenewFraction, false},
+	&testfraction{0.5, 0.5, false},
+	&testfraction{1, 0, true},
+	&testfraction{-0.5, 0, true},
+}
+
+func TestRenewFraction(t *testing.T) {
+	for _, pair := range testfractions {
+		r := &RetrieVault{Config: Config{RenewFraction: pair.value}}
+		fraction, err := r.renewFraction()
+		if pair.e {
+			if err == nil {
+				t.Error("For", pair.value,
+					"expected non nil error",
+					"got nil error")
+			}
+		} else if fraction != pair.expected {
+			t.Error("For", pair.value,
+				"expected", pair.expected,
+				"got", fraction)
+		}
+	}
+}
+
+type testnext struct {
+	lease    *api.Secret
+	expected time.Duration
+}
+
+var testnexts = []*testnext{
+	&testnext{nil, 5 * time.Minute},
+	&testnext{&api.Secret{LeaseDuration: 0}, 5 * time.Minute},
+	&testnext{&api.Secret{LeaseDuration: 3600}, 30 * time.Minute},
+}
+
+func TestWatcherNext(t *testing.T) {
+	w := &watcher{fraction: 0.5, interval: 5 * time.Minute}
+	for _, pair := range testnexts {
+		if next := w.next(pair.lease); next != pair.expected {
+			t.Error("For", pair.lease,
+				"expected", pair.expected,
+				"got", next)
+		}
+	}
+}
+
+func TestWatcherFetchHook(t *testing.T) {
+	config, _, stop := testVaultConfig(map[string]interface{}{
+		"/v1/secret/app": map[string]interface{}{
+			"data": map[string]interface{}{"password": "s3cr3t"},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The hook takes longer than the fetch timeout, which must not bound it
+	marker := path.Join(dir, "reloaded")
+	secret := &Secret{Type: generic, Path: path.Join(dir, "app"), VaultPath: "secret/app", OnChange: &OnChange{
+		Command: []string{"sh", "-c", "sleep 0.2 && touch " + marker},
+	}}
+	r, err := New(Config{VaultToken: "token", Secrets: []*Secret{secret}}, WithVaultConfig(config))
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	w := &watcher{secret: secret, timeout: 100 * time.Millisecond, rvault: r}
+	if err := w.fetch(context.Background()); err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Error("Expected the hook to complete, got", err)
+	}
+
+	// The hook is stopped once the daemon is
+	secret.OnChange = &OnChange{Command: []string{"sleep", "1"}}
+	os.Remove(path.Join(dir, "app", "password"))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if err := w.fetch(ctx); err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Error("Expected the hook to be cancelled, took", elapsed)
+	}
+}
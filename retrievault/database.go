@@ -0,0 +1,155 @@
+package retrievault
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"text/template"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// Database fetches dynamic credentials from one of the database backends
+// (postgresql, mysql, mssql, mongodb...), reading them from the
+// "<mount>/creds/<role>" path. The username and the password are written in
+// their own files, and a connection string can be rendered in another one.
+type Database struct {
+
+	// Username is the destination of the username
+	Username fileParameters `json:"username,omitempty"`
+
+	// Password is the destination of the password
+	Password fileParameters `json:"password,omitempty"`
+
+	// Connection renders a DSN or a JDBC URL with the credentials
+	Connection *connectionParams `json:"connection,omitempty"`
+
+	// Revoke revokes the lease of the credentials when the daemon stops, so
+	// that they don't outlive the service using them.
+	Revoke bool `json:"revoke_on_shutdown,omitempty"`
+
+	secret *api.Secret
+	writer
+}
+
+// connectionParams holds the template of a connection string, which is
+// rendered with the fields Username and Password, e.g.:
+//
+//	postgres://{{ .Username }}:{{ .Password }}@db:5432/app
+type connectionParams struct {
+	Template string `json:"template"`
+	fileParameters
+}
+
+func NewDatabase() *Database {
+	return new(Database)
+}
+
+// Lease returns the last credentials fetched.
+func (d *Database) Lease() *api.Secret {
+	return d.secret
+}
+
+// RevokeOnShutdown reports whether the lease of the credentials must be
+// revoked when the daemon stops.
+func (d *Database) RevokeOnShutdown() bool {
+	return d.Revoke
+}
+
+// connection renders the connection string with the given credentials. The
+// "urlquery" and "pathEscape" functions escape them to be used in a URL.
+func (d *Database) connection(username, password string) ([]byte, error) {
+	if d.Connection.Template == "" {
+		return nil, fmt.Errorf("No template set for the connection string")
+	}
+	tmpl, err := template.New("connection").Funcs(template.FuncMap{
+		"pathEscape": url.PathEscape,
+	}).Option("missingkey=error").Parse(d.Connection.Template)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, struct{ Username, Password string }{username, password})
+	return buf.Bytes(), err
+}
+
+func (d *Database) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
+	log.Msg.WithField("vault_path", vaultPath).Debug("Fetching secret at path")
+	secret, err := client.Read(vaultPath)
+	if err != nil {
+		e <- err
+		return
+	}
+	if secret == nil {
+		e <- fmt.Errorf("No credentials found at path %s", vaultPath)
+		return
+	}
+	d.secret = secret
+	log.Msg.WithFields(logrus.Fields{
+		"vault_path": vaultPath,
+		"lease_id":   secret.LeaseID,
+	}).Info("Database credentials issued")
+
+	username, _ := secret.Data["username"].(string)
+	password, _ := secret.Data["password"].(string)
+	if username == "" || password == "" {
+		e <- fmt.Errorf("No username or password found at path %s", vaultPath)
+		return
+	}
+
+	// The username and the password are switched together, so that a
+	// consumer never reads a new username next to an old password
+	type output struct {
+		name        string
+		defaultFile string
+		params      fileParameters
+		data        []byte
+	}
+	outputs := []output{
+		{"username", "username", d.Username, []byte(username)},
+		{"password", "password", d.Password, []byte(password)},
+	}
+	if d.Connection != nil {
+		data, err := d.connection(username, password)
+		if err != nil {
+			log.Msg.WithField("msg", err.Error()).Error("Error when rendering connection string")
+			e <- err
+			return
+		}
+		outputs = append(outputs, output{"connection", "connection", d.Connection.fileParameters, data})
+	}
+	var files []*fileContent
+	for _, o := range outputs {
+		file, perm, err := d.getDestAndPerms(o.defaultFile, o.params, dest)
+		if err != nil {
+			log.Msg.WithFields(logrus.Fields{
+				"secret":      o.name,
+				"permissions": perm,
+			}).Error(err.Error())
+			e <- err
+			return
+		}
+		files = append(files, &fileContent{path: file, data: o.data, perm: perm})
+	}
+
+	er := make(chan error, 1)
+	go d.writeInFiles(files, er)
+	select {
+	case <-ctx.Done():
+		log.Msg.Error("Parent context cancelled")
+		e <- ctx.Err()
+		return
+	case err := <-er:
+		if err != nil {
+			log.Msg.Error("Error when writing secret to file")
+			e <- err
+			return
+		}
+	}
+
+	e <- nil
+	return
+}
@@ -0,0 +1,126 @@
+package retrievault
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestDatabaseFetchSecret(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/postgresql/creds/readonly": map[string]interface{}{
+			"lease_id":       "postgresql/creds/readonly/1234",
+			"lease_duration": 3600,
+			"renewable":      true,
+			"data":           map[string]interface{}{"username": "root-1234", "password": "p@ss/word"},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &Database{
+		Password: fileParameters{Perm: "0600"},
+		Connection: &connectionParams{
+			Template:       "postgres://{{ .Username }}:{{ .Password | pathEscape }}@db:5432/app",
+			fileParameters: fileParameters{Path: "dsn"},
+		},
+	}
+	e := make(chan error, 1)
+	d.FetchSecret(context.Background(), "postgresql/creds/readonly", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	files := map[string]string{
+		"username": "root-1234",
+		"password": "p@ss/word",
+		"dsn":      "postgres://root-1234:p@ss%2Fword@db:5432/app",
+	}
+	for file, expected := range files {
+		content, _ := ioutil.ReadFile(path.Join(dir, file))
+		if string(content) != expected {
+			t.Error("For", file, "expected", expected, "got", string(content))
+		}
+	}
+	if lease := d.Lease(); lease == nil || lease.LeaseID != "postgresql/creds/readonly/1234" {
+		t.Error("Expected lease", "postgresql/creds/readonly/1234", "got", lease)
+	}
+}
+
+func TestWatcherRevoke(t *testing.T) {
+	client, requests, stop := testVault(t, map[string]interface{}{
+		"/v1/sys/revoke/postgresql/creds/readonly/1234": map[string]interface{}{},
+	})
+	defer stop()
+	lease := &api.Secret{LeaseID: "postgresql/creds/readonly/1234"}
+	for _, revoke := range []bool{false, true} {
+		w := &watcher{
+			secret: &Secret{Type: database},
+			retr:   &Database{Revoke: revoke},
+			rvault: &RetrieVault{identity: &identity{client: client, tokens: &tokenManager{client: client}}},
+		}
+		w.revoke(lease)
+	}
+	if len(*requests) != 1 || (*requests)[0].method != "PUT" {
+		t.Error("Expected a single lease revocation, got", len(*requests), "requests")
+	}
+}
+
+func TestWatcherFetchRevoke(t *testing.T) {
+	config, requests, stop := testVaultConfig(map[string]interface{}{
+		"/v1/postgresql/creds/readonly": map[string]interface{}{
+			"lease_id":       "postgresql/creds/readonly/5678",
+			"lease_duration": 3600,
+			"renewable":      true,
+			"data":           map[string]interface{}{"username": "root-5678", "password": "s3cr3t"},
+		},
+		"/v1/sys/revoke/postgresql/creds/readonly/1234": map[string]interface{}{},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := &Secret{
+		Type:       database,
+		Path:       dir,
+		VaultPath:  "postgresql/creds/readonly",
+		Parameters: json.RawMessage(`{"revoke_on_shutdown":true}`),
+	}
+	r, err := New(Config{VaultToken: "token", Secrets: []*Secret{secret}}, WithVaultConfig(config))
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	w := &watcher{
+		secret:  secret,
+		retr:    &Database{Revoke: true, secret: &api.Secret{LeaseID: "postgresql/creds/readonly/1234"}},
+		timeout: time.Second,
+		rvault:  r,
+	}
+	if err := w.fetch(context.Background()); err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	revoked := 0
+	for _, req := range *requests {
+		if req.path == "/v1/sys/revoke/postgresql/creds/readonly/1234" {
+			revoked++
+		}
+	}
+	if revoked != 1 {
+		t.Error("Expected the previous lease to be revoked once, got", revoked, "revocations")
+	}
+	if lease := w.lease(); lease == nil || lease.LeaseID != "postgresql/creds/readonly/5678" {
+		t.Error("Expected lease", "postgresql/creds/readonly/5678", "got", lease)
+	}
+}
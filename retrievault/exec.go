@@ -0,0 +1,185 @@
+package retrievault
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+)
+
+// DefaultStopTimeout is the time the command run by Exec is given to exit
+// once it has been asked to, before it is killed.
+const DefaultStopTimeout = 10 * time.Second
+
+// setEnv stores the environment variables exposed by a secret, and notifies
+// envUpdates if they changed since its last fetch.
+func (r *RetrieVault) setEnv(secret *Secret, env map[string]string) {
+	r.envMu.Lock()
+	defer r.envMu.Unlock()
+	if r.envs == nil {
+		r.envs = make(map[*Secret]map[string]string)
+	}
+	previous, fetched := r.envs[secret]
+	r.envs[secret] = env
+	if !fetched || reflect.DeepEqual(previous, env) || r.envUpdates == nil {
+		return
+	}
+	log.Msg.WithField("vault_path", secret.VaultPath).Info("Environment variables changed")
+	select {
+	case r.envUpdates <- struct{}{}:
+	default:
+		// An update is already pending
+	}
+}
+
+// Env returns the environment variables exposed by the secrets fetched, by
+// name. If several secrets expose the same variable, the last one in
+// Config.Secrets wins.
+func (r *RetrieVault) Env() map[string]string {
+	r.envMu.Lock()
+	defer r.envMu.Unlock()
+	env := make(map[string]string)
+	for _, secret := range r.Secrets {
+		for name, value := range r.envs[secret] {
+			env[name] = value
+		}
+	}
+	return env
+}
+
+// mergeEnv returns base, a list of "NAME=value" entries, with the variables
+// in env set.
+func mergeEnv(base []string, env map[string]string) []string {
+	merged := make([]string, 0, len(base)+len(env))
+	for _, entry := range base {
+		name := strings.SplitN(entry, "=", 2)[0]
+		if _, ok := env[name]; !ok {
+			merged = append(merged, entry)
+		}
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		merged = append(merged, name+"="+env[name])
+	}
+	return merged
+}
+
+// Exec fetches all the secrets and runs command with the environment
+// variables they expose. Unless daemon is set, the command replaces the
+// current process. Otherwise, the secrets are kept up to date, as done by
+// Daemon, and the command is restarted whenever the variables change, or sent
+// the signal sig if set. Exec returns once the command exits, or stops it
+// once ctx is cancelled.
+func (r *RetrieVault) Exec(ctx context.Context, command []string, timeout time.Duration, daemon bool, sig string) error {
+	if len(command) == 0 {
+		return fmt.Errorf("No command to run")
+	}
+	binary, err := exec.LookPath(command[0])
+	if err != nil {
+		return err
+	}
+	var signal syscall.Signal
+	if sig != "" {
+		var ok bool
+		if signal, ok = signals[strings.ToUpper(sig)]; !ok {
+			return fmt.Errorf("Unknown signal %s", sig)
+		}
+	}
+
+	if !daemon {
+		fetchCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if err := r.FetchSecrets(fetchCtx); err != nil {
+			return err
+		}
+		log.Msg.WithField("command", strings.Join(command, " ")).Info("Running command")
+		return syscall.Exec(binary, command, mergeEnv(os.Environ(), r.Env()))
+	}
+
+	r.envMu.Lock()
+	r.envUpdates = make(chan struct{}, 1)
+	r.envMu.Unlock()
+	// The secrets are kept up to date until the command has stopped, so that
+	// their leases are not revoked while it still runs
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	wait, err := r.startDaemon(watchCtx, timeout)
+	if err != nil {
+		stopWatching()
+		return err
+	}
+	defer wait()
+	defer stopWatching()
+	return r.supervise(ctx, binary, command, signal)
+}
+
+// supervise runs the command until it exits or ctx is cancelled, restarting
+// it, or sending it signal if set, whenever the environment variables change.
+func (r *RetrieVault) supervise(ctx context.Context, binary string, command []string, signal syscall.Signal) error {
+	for {
+		cmd := exec.Command(binary, command[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = mergeEnv(os.Environ(), r.Env())
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		logger := log.Msg.WithFields(logrus.Fields{
+			"command": strings.Join(command, " "),
+			"pid":     cmd.Process.Pid,
+		})
+		logger.Info("Command started")
+		exited := make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+
+		restart := false
+		for !restart {
+			select {
+			case err := <-exited:
+				logger.WithField("exit_status", cmd.ProcessState.ExitCode()).Info("Command exited")
+				return err
+			case <-ctx.Done():
+				stopCommand(cmd, exited)
+				logger.WithField("exit_status", cmd.ProcessState.ExitCode()).Info("Command stopped")
+				return nil
+			case <-r.envUpdates:
+				if signal != 0 {
+					logger.WithField("signal", signal.String()).Info("Secrets changed. Signalling command...")
+					if err := cmd.Process.Signal(signal); err != nil {
+						logger.WithField("msg", err.Error()).Error("Error when signalling command")
+					}
+					continue
+				}
+				logger.Info("Secrets changed. Restarting command...")
+				stopCommand(cmd, exited)
+				restart = true
+			}
+		}
+	}
+}
+
+// stopCommand asks the command to exit with SIGTERM, kills it if it is still
+// running after DefaultStopTimeout, and waits until it has exited.
+func stopCommand(cmd *exec.Cmd, exited chan error) {
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(DefaultStopTimeout):
+		cmd.Process.Kill()
+		<-exited
+	}
+}
@@ -0,0 +1,149 @@
+package retrievault
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type testmergeenv struct {
+	base     []string
+	env      map[string]string
+	expected []string
+}
+
+var testmergeenvs = []*testmergeenv{
+	&testmergeenv{[]string{"PATH=/bin", "HOME=/root"}, map[string]string{}, []string{"PATH=/bin", "HOME=/root"}},
+	&testmergeenv{[]string{"PATH=/bin", "PASSWORD=old"}, map[string]string{"PASSWORD": "new", "API_KEY": "k=v"}, []string{"PATH=/bin", "API_KEY=k=v", "PASSWORD=new"}},
+}
+
+func TestMergeEnv(t *testing.T) {
+	for _, test := range testmergeenvs {
+		if merged := mergeEnv(test.base, test.env); !reflect.DeepEqual(merged, test.expected) {
+			t.Error("For", test.base, test.env, "expected", test.expected, "got", merged)
+		}
+	}
+}
+
+func TestSetEnv(t *testing.T) {
+	secrets := []*Secret{&Secret{VaultPath: "secret/a"}, &Secret{VaultPath: "secret/b"}}
+	r := &RetrieVault{Config: Config{Secrets: secrets}}
+	r.envUpdates = make(chan struct{}, 1)
+	r.setEnv(secrets[0], map[string]string{"USER": "a", "PASSWORD": "1"})
+	r.setEnv(secrets[1], map[string]string{"PASSWORD": "2"})
+	r.setEnv(secrets[0], map[string]string{"USER": "a", "PASSWORD": "1"})
+	select {
+	case <-r.envUpdates:
+		t.Error("Expected no update until a secret fetched before changes")
+	default:
+	}
+	r.setEnv(secrets[0], map[string]string{"USER": "b", "PASSWORD": "1"})
+	select {
+	case <-r.envUpdates:
+	default:
+		t.Error("Expected an update once a secret changed")
+	}
+	expected := map[string]string{"USER": "b", "PASSWORD": "2"}
+	if env := r.Env(); !reflect.DeepEqual(env, expected) {
+		t.Error("Expected", expected, "got", env)
+	}
+}
+
+type testsupervise struct {
+	signal   syscall.Signal
+	expected string
+}
+
+var testsupervises = []*testsupervise{
+	// The command is restarted with the new value
+	&testsupervise{0, "old\nnew\n"},
+	// The command is signalled, and keeps the old value
+	&testsupervise{syscall.SIGUSR1, "old\nsignalled\n"},
+}
+
+func TestSupervise(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range testsupervises {
+		output := path.Join(dir, string(rune('a'+i)))
+		script := `trap 'echo signalled >> "$0"' USR1; echo "$VALUE" >> "$0"; while true; do sleep 0.05; done`
+		secret := &Secret{VaultPath: "secret/app"}
+		r := &RetrieVault{Config: Config{Secrets: []*Secret{secret}}}
+		r.envUpdates = make(chan struct{}, 1)
+		r.setEnv(secret, map[string]string{"VALUE": "old"})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- r.supervise(ctx, "/bin/sh", []string{"sh", "-c", script, output}, test.signal)
+		}()
+		waitForContent(output, "old\n")
+		r.setEnv(secret, map[string]string{"VALUE": "new"})
+		waitForContent(output, test.expected)
+		cancel()
+		if err := <-done; err != nil {
+			t.Error("For", test.signal, "expected nil error, got", err)
+		}
+		content, _ := ioutil.ReadFile(output)
+		if string(content) != test.expected {
+			t.Error("For", test.signal, "expected", test.expected, "got", string(content))
+		}
+	}
+}
+
+// waitForContent waits up to a few seconds for file to hold content.
+func waitForContent(file, content string) {
+	for i := 0; i < 100; i++ {
+		current, _ := ioutil.ReadFile(file)
+		if strings.TrimSpace(string(current)) == strings.TrimSpace(content) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestGenericEnv(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/secret/app": map[string]interface{}{
+			"data": map[string]interface{}{"user": "app", "password": "s3cr3t", "key": "k"},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g := &Generic{Keys: map[string]genericParams{
+		"password": genericParams{Env: "DB_PASSWORD"},
+		"user":     genericParams{Env: "DB_USER", fileParameters: fileParameters{Path: "user"}},
+	}}
+	e := make(chan error, 1)
+	g.FetchSecret(context.Background(), "secret/app", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	expected := map[string]string{"DB_PASSWORD": "s3cr3t", "DB_USER": "app"}
+	if env := g.Env(); !reflect.DeepEqual(env, expected) {
+		t.Error("Expected", expected, "got", env)
+	}
+	// Keys exposed as environment variables are only written if they have a
+	// path
+	files := map[string]bool{"user": true, "key": true, "password": false}
+	for file, exists := range files {
+		if _, err := os.Stat(path.Join(dir, file)); (err == nil) != exists {
+			t.Error("For", file, "expected the file to exist", exists, "got", err)
+		}
+	}
+}
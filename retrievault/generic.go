@@ -2,6 +2,7 @@ package retrievault
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path"
@@ -14,10 +15,17 @@ import (
 type Generic struct {
 	Keys   map[string]genericParams `json:"keys,omitempty"`
 	secret *api.Secret
+	env    map[string]string
 	writer
 }
 
 type genericParams struct {
+
+	// Env is the name of the environment variable the key is exposed as, to
+	// the command run by "retrievault exec". If set, the key is only written
+	// in a file if a path is set too.
+	Env string `json:"env,omitempty"`
+
 	fileParameters
 }
 
@@ -25,6 +33,17 @@ func NewGeneric() *Generic {
 	return new(Generic)
 }
 
+// Lease returns the last secret fetched.
+func (g *Generic) Lease() *api.Secret {
+	return g.secret
+}
+
+// Env returns the keys of the last secret fetched which are exposed as
+// environment variables, by name.
+func (g *Generic) Env() map[string]string {
+	return g.env
+}
+
 func (g *Generic) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
 	log.Msg.WithField("vault_path", vaultPath).Debug("Fetching secret at path")
 	secrets, err := client.Read(vaultPath)
@@ -32,8 +51,21 @@ func (g *Generic) FetchSecret(ctx context.Context, vaultPath, dest string, clien
 		e <- err
 		return
 	}
-	er := make(chan error)
-	for key, secret := range secrets.Data {
+	if secrets == nil {
+		e <- fmt.Errorf("No secret found at path %s", vaultPath)
+		return
+	}
+	g.secret = secrets
+	g.writeKeys(ctx, secrets.Data, dest, e)
+}
+
+// writeKeys writes each key of data in its own file, at the location set in
+// Keys or, if not set, at a file named after the key in dest.
+func (g *Generic) writeKeys(ctx context.Context, data map[string]interface{}, dest string, e chan error) {
+	er := make(chan error, len(data))
+	g.env = make(map[string]string)
+	written := 0
+	for key, secret := range data {
 		select {
 		case <-ctx.Done():
 			log.Msg.Error("Parent context cancelled")
@@ -45,7 +77,7 @@ func (g *Generic) FetchSecret(ctx context.Context, vaultPath, dest string, clien
 		if !ok {
 			errMsg := "Error when getting secret as string"
 			log.Msg.WithField("secret", key).Error(errMsg)
-			e <- fmt.Errorf(errMsg)
+			e <- errors.New(errMsg)
 			return
 		}
 		var (
@@ -54,6 +86,12 @@ func (g *Generic) FetchSecret(ctx context.Context, vaultPath, dest string, clien
 			err  error
 		)
 		if fparams, ok := g.Keys[key]; ok {
+			if fparams.Env != "" {
+				g.env[fparams.Env] = stringSecret
+				if fparams.Path == "" {
+					continue
+				}
+			}
 			file, perm, err = g.getDestAndPerms(key, fparams.fileParameters, dest)
 		} else {
 			file, perm, err = g.getDestAndPerms(key, fileParameters{}, dest)
@@ -67,9 +105,10 @@ func (g *Generic) FetchSecret(ctx context.Context, vaultPath, dest string, clien
 			return
 		}
 		go g.writeInFile(path.Clean(file), []byte(stringSecret), perm, er)
+		written++
 	}
 
-	for i := 0; i < len(secrets.Data); i++ {
+	for i := 0; i < written; i++ {
 		select {
 		case <-ctx.Done():
 			log.Msg.Error("Parent context cancelled")
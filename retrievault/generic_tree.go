@@ -0,0 +1,299 @@
+package retrievault
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/DatioBD/retrievault/utils/os/permissions"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// GenericTree fetches every secret under a prefix of a generic backend, and
+// mirrors the hierarchy in the destination directory: the key "user" of the
+// secret at "<prefix>/db/admin" is written at "<dest>/db/admin/user".
+type GenericTree struct {
+
+	// Include is a list of glob patterns. If set, only the secrets whose path
+	// relative to the prefix matches any of them are fetched.
+	Include []string `json:"include,omitempty"`
+
+	// Exclude is a list of glob patterns. The secrets whose path relative to
+	// the prefix matches any of them are not fetched.
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Prune removes the files written by a previous fetch which don't belong
+	// to any of the secrets fetched anymore. The files written are recorded
+	// in a manifest in the destination directory.
+	Prune bool `json:"prune,omitempty"`
+
+	// Perm are the permissions of every file written
+	Perm string `json:"perm,omitempty"`
+
+	writer
+}
+
+func NewGenericTree() *GenericTree {
+	return new(GenericTree)
+}
+
+// manifestFile returns the file, in dest, which records the files written
+// for the secrets under vaultPath. Trees of different prefixes can share the
+// same destination directory.
+func manifestFile(dest, vaultPath string) string {
+	name := strings.Replace(strings.Trim(vaultPath, "/"), "/", "_", -1)
+	return path.Join(dest, ".retrievault-tree-"+name)
+}
+
+// readManifest returns the files, relative to dest, recorded in a manifest.
+// Nothing is returned if it doesn't exist yet.
+func readManifest(manifest string) ([]string, error) {
+	content, err := ioutil.ReadFile(manifest)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// matches reports whether name matches any of the glob patterns.
+func matches(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		match, err := path.Match(pattern, name)
+		if err != nil {
+			return false, fmt.Errorf("Invalid pattern %s: %s", pattern, err)
+		}
+		if match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// selected reports whether the secret at name, relative to the prefix, must
+// be fetched according to Include and Exclude.
+func (g *GenericTree) selected(name string) (bool, error) {
+	if len(g.Include) != 0 {
+		included, err := matches(g.Include, name)
+		if err != nil || !included {
+			return false, err
+		}
+	}
+	excluded, err := matches(g.Exclude, name)
+	return !excluded, err
+}
+
+// validName checks that name, taken from Vault, can't be used to write
+// outside of the destination directory.
+func validName(name string) error {
+	for _, element := range strings.Split(name, "/") {
+		if element == "" || element == "." || element == ".." {
+			return fmt.Errorf("Invalid secret name %s", name)
+		}
+	}
+	return nil
+}
+
+// list returns the path of every secret under prefix, relative to it.
+func (g *GenericTree) list(ctx context.Context, client *api.Logical, prefix, folder string) ([]string, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	listPath := strings.TrimSuffix(path.Join(prefix, folder), "/")
+	log.Msg.WithField("vault_path", listPath).Debug("Listing secrets at path")
+	secret, err := client.List(listPath)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	keys, _ := secret.Data["keys"].([]interface{})
+	var names []string
+	for _, k := range keys {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected key %v listed at %s", k, listPath)
+		}
+		name := path.Join(folder, key)
+		if err := validName(name); err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(key, "/") {
+			sub, err := g.list(ctx, client, prefix, name)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, sub...)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// prune removes the files recorded in the manifest of the tree which are
+// not in files anymore, along with the directories left empty, and records
+// files in the manifest. Nothing else under dest is ever removed.
+func (g *GenericTree) prune(dest, vaultPath string, files []*fileContent) error {
+	manifest := manifestFile(dest, vaultPath)
+	previous, err := readManifest(manifest)
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]bool, len(files))
+	var current []string
+	for _, f := range files {
+		name := strings.TrimPrefix(f.path, dest+"/")
+		keep[name] = true
+		current = append(current, name)
+	}
+	for _, name := range previous {
+		if keep[name] || validName(name) != nil {
+			continue
+		}
+		file := path.Join(dest, name)
+		log.Msg.WithField("file", file).Info("Secret no longer in Vault. Removing file...")
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		g.setChanged()
+		// Remove the directories left empty, up to dest. Those which
+		// aren't empty fail to be removed and are kept.
+		for dir := path.Dir(file); dir != dest; dir = path.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+
+	sort.Strings(current)
+	content := strings.Join(current, "\n")
+	if len(current) > 0 {
+		content += "\n"
+	}
+	er := make(chan error, 1)
+	new(writer).writeInFile(manifest, []byte(content), 0600, er)
+	return <-er
+}
+
+// FetchSecret fetches every secret under vaultPath and writes them together,
+// so that the tree is never left half updated.
+func (g *GenericTree) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
+	if g.Prune && dest == "" {
+		e <- fmt.Errorf("A path must be set in order to prune the secrets at %s", vaultPath)
+		return
+	}
+	perm := os.FileMode(0644)
+	if g.Perm != "" {
+		var err error
+		if perm, err = permissions.StringToFileMode(g.Perm); err != nil {
+			e <- fmt.Errorf("Wrong permission format. Must be something like \"0644\" or \"0600\"")
+			return
+		}
+	}
+	if dest == "" {
+		dest = "."
+	}
+	dest = path.Clean(dest)
+
+	names, err := g.list(ctx, client, vaultPath, "")
+	if err != nil {
+		e <- err
+		return
+	}
+	var files []*fileContent
+	for _, name := range names {
+		if ok, err := g.selected(name); err != nil {
+			e <- err
+			return
+		} else if !ok {
+			log.Msg.WithField("secret", name).Debug("Secret filtered out. Skipping...")
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			log.Msg.Error("Parent context cancelled")
+			e <- ctx.Err()
+			return
+		default:
+		}
+		secretPath := path.Join(vaultPath, name)
+		log.Msg.WithField("vault_path", secretPath).Debug("Fetching secret at path")
+		secret, err := client.Read(secretPath)
+		if err != nil {
+			e <- err
+			return
+		}
+		if secret == nil {
+			// The secret was removed after being listed
+			continue
+		}
+		for key, value := range secret.Data {
+			stringSecret, ok := value.(string)
+			if !ok {
+				errMsg := "Error when getting secret as string"
+				log.Msg.WithFields(logrus.Fields{
+					"vault_path": secretPath,
+					"secret":     key,
+				}).Error(errMsg)
+				e <- fmt.Errorf("%s %s of %s", errMsg, key, secretPath)
+				return
+			}
+			if err := validName(key); err != nil {
+				e <- err
+				return
+			}
+			files = append(files, &fileContent{path.Join(dest, name, key), []byte(stringSecret), perm})
+		}
+	}
+
+	er := make(chan error, 1)
+	go g.writeInFiles(files, er)
+	select {
+	case <-ctx.Done():
+		log.Msg.Error("Parent context cancelled")
+		e <- ctx.Err()
+		return
+	case err := <-er:
+		if err != nil {
+			log.Msg.Error("Error when writing secret to file")
+			e <- err
+			return
+		}
+	}
+	if g.Prune && !g.inMemory() && len(names) == 0 {
+		// An empty listing is most likely a wrong prefix or a lack of
+		// permissions, rather than every secret being removed
+		log.Msg.WithField("vault_path", vaultPath).Warn("No secrets listed. Skipping pruning...")
+	} else if g.Prune && !g.inMemory() {
+		if err := g.prune(dest, vaultPath, files); err != nil {
+			log.Msg.WithField("msg", err.Error()).Error("Error when pruning secrets")
+			e <- err
+			return
+		}
+	}
+	log.Msg.WithFields(logrus.Fields{
+		"vault_path": vaultPath,
+		"secrets":    len(names),
+		"files":      len(files),
+	}).Info("Secret tree fetched")
+	e <- nil
+	return
+}
@@ -0,0 +1,127 @@
+package retrievault
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type testselection struct {
+	name     string
+	expected bool
+}
+
+var testselections = []*testselection{
+	&testselection{"db/admin", true},
+	&testselection{"db/readonly", false},
+	&testselection{"api", true},
+	&testselection{"cache", false},
+}
+
+func TestGenericTreeSelected(t *testing.T) {
+	g := &GenericTree{Include: []string{"db/*", "api"}, Exclude: []string{"*/readonly"}}
+	for _, pair := range testselections {
+		selected, err := g.selected(pair.name)
+		if err != nil {
+			t.Error("For", pair.name, "expected nil error", "got", err)
+		} else if selected != pair.expected {
+			t.Error("For", pair.name, "expected", pair.expected, "got", selected)
+		}
+	}
+}
+
+var testtreeresponses = map[string]interface{}{
+	"/v1/secret/app": map[string]interface{}{
+		"data": map[string]interface{}{"keys": []string{"api", "db/"}},
+	},
+	"/v1/secret/app/db": map[string]interface{}{
+		"data": map[string]interface{}{"keys": []string{"admin", "readonly"}},
+	},
+	"/v1/secret/app/api": map[string]interface{}{
+		"data": map[string]interface{}{"token": "abc"},
+	},
+	"/v1/secret/app/db/admin": map[string]interface{}{
+		"data": map[string]interface{}{"user": "admin", "password": "secret"},
+	},
+}
+
+func TestGenericTreeFetchSecret(t *testing.T) {
+	client, _, stop := testVault(t, testtreeresponses)
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g := &GenericTree{Exclude: []string{"db/readonly"}, Prune: true}
+	e := make(chan error, 1)
+	g.FetchSecret(context.Background(), "secret/app", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	files := map[string]string{
+		"api/token":         "abc",
+		"db/admin/user":     "admin",
+		"db/admin/password": "secret",
+	}
+	for file, expected := range files {
+		content, _ := ioutil.ReadFile(path.Join(dir, file))
+		if string(content) != expected {
+			t.Error("For", file, "expected", expected, "got", string(content))
+		}
+	}
+}
+
+func TestGenericTreePrune(t *testing.T) {
+	client, _, stop := testVault(t, testtreeresponses)
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Files not written by the tree are never pruned
+	other := path.Join(dir, "other", "config")
+	os.MkdirAll(path.Dir(other), 0700)
+	ioutil.WriteFile(other, []byte("other"), 0600)
+
+	g := &GenericTree{Prune: true}
+	e := make(chan error, 1)
+	g.FetchSecret(context.Background(), "secret/app", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+
+	// The secrets removed from Vault are pruned
+	g = &GenericTree{Include: []string{"api"}, Prune: true}
+	g.FetchSecret(context.Background(), "secret/app", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if !g.Changed() {
+		t.Error("Expected the pruned secrets to be reported as a change")
+	}
+	if _, err := os.Stat(path.Join(dir, "db")); !os.IsNotExist(err) {
+		t.Error("Expected", path.Join(dir, "db"), "to be pruned, got", err)
+	}
+	for _, file := range []string{"api/token", "other/config"} {
+		if _, err := os.Stat(path.Join(dir, file)); err != nil {
+			t.Error("For", file, "expected nil error", "got", err)
+		}
+	}
+
+	// An empty listing prunes nothing
+	empty, _, stopEmpty := testVault(t, map[string]interface{}{})
+	defer stopEmpty()
+	g = &GenericTree{Prune: true}
+	g.FetchSecret(context.Background(), "secret/app", dir, empty.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "api", "token")); err != nil {
+		t.Error("Expected", path.Join(dir, "api", "token"), "to be kept, got", err)
+	}
+}
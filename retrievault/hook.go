@@ -0,0 +1,133 @@
+package retrievault
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+)
+
+// DefaultHookTimeout is the maximum time a hook command may run, if no other
+// timeout is configured.
+const DefaultHookTimeout = "30s"
+
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// OnChange holds the actions to take once the files of a secret have been
+// written with new content, so that the processes consuming them can be
+// reloaded.
+type OnChange struct {
+
+	// Command is the command to run, along with its arguments
+	Command []string `json:"command,omitempty"`
+
+	// Signal is the name of the signal (e.g.: "SIGHUP") sent to the process
+	// whose PID is stored in PidFile
+	Signal string `json:"signal,omitempty"`
+
+	// PidFile is the path to the file holding the PID of the process to signal
+	PidFile string `json:"pidfile,omitempty"`
+
+	// Timeout is the maximum time the command may run. If not set, "30s" will
+	// be taken as default.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// run runs the command and sends the signal configured, if any. Both are
+// attempted even if the other one fails.
+func (o *OnChange) run(ctx context.Context) error {
+	var errs []string
+	if len(o.Command) > 0 {
+		if err := o.runCommand(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if o.Signal != "" || o.PidFile != "" {
+		if err := o.sendSignal(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (o *OnChange) runCommand(ctx context.Context) error {
+	timeout := o.Timeout
+	if timeout == "" {
+		timeout = DefaultHookTimeout
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return err
+	}
+	cmdCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	cmd := exec.CommandContext(cmdCtx, o.Command[0], o.Command[1:]...)
+	output, err := cmd.CombinedOutput()
+	fields := logrus.Fields{
+		"command": strings.Join(o.Command, " "),
+		"output":  strings.TrimSpace(string(output)),
+	}
+	if cmd.ProcessState != nil {
+		fields["exit_status"] = cmd.ProcessState.ExitCode()
+	}
+	if cmdCtx.Err() == context.DeadlineExceeded {
+		log.Msg.WithFields(fields).Error("Hook command timed out")
+		return fmt.Errorf("Command %s timed out after %s", o.Command[0], timeout)
+	}
+	if err != nil {
+		log.Msg.WithFields(fields).Error("Hook command failed")
+		return err
+	}
+	log.Msg.WithFields(fields).Info("Hook command executed")
+	return nil
+}
+
+func (o *OnChange) sendSignal() error {
+	if o.Signal == "" || o.PidFile == "" {
+		return fmt.Errorf("Both signal and pidfile must be set in order to send a signal")
+	}
+	sig, ok := signals[strings.ToUpper(o.Signal)]
+	if !ok {
+		return fmt.Errorf("Invalid signal %s", o.Signal)
+	}
+	content, err := ioutil.ReadFile(o.PidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return fmt.Errorf("Invalid PID in %s", o.PidFile)
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := process.Signal(sig); err != nil {
+		return err
+	}
+	log.Msg.WithFields(logrus.Fields{
+		"signal": o.Signal,
+		"pid":    pid,
+	}).Info("Signal sent")
+	return nil
+}
@@ -0,0 +1,35 @@
+package retrievault
+
+import (
+	"context"
+	"testing"
+)
+
+type testhook struct {
+	hook *OnChange
+	e    bool
+}
+
+var testhooks = []*testhook{
+	&testhook{&OnChange{Command: []string{"true"}}, false},
+	&testhook{&OnChange{Command: []string{"false"}}, true},
+	&testhook{&OnChange{Command: []string{"sleep", "1"}, Timeout: "10ms"}, true},
+	&testhook{&OnChange{Signal: "SIGHUP"}, true},
+	&testhook{&OnChange{Signal: "SIGFOO", PidFile: "/dev/null"}, true},
+}
+
+func TestOnChangeRun(t *testing.T) {
+	for _, pair := range testhooks {
+		err := pair.hook.run(context.Background())
+		if pair.e && err == nil {
+			t.Error("For", pair.hook,
+				"expected non nil error",
+				"got nil error")
+		}
+		if !pair.e && err != nil {
+			t.Error("For", pair.hook,
+				"expected nil error",
+				"got", err)
+		}
+	}
+}
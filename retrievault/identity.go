@@ -0,0 +1,187 @@
+package retrievault
+
+import (
+	"encoding/json"
+	"fmt"
+
+	env "github.com/DatioBD/retrievault/utils/environment"
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// identity is a Vault client, along with the manager which keeps its token
+// alive. All the secrets fetched with the same credentials share the same
+// identity.
+type identity struct {
+	client *api.Client
+	tokens *tokenManager
+}
+
+// checkAuth checks that the requirements of the authentication method are
+// met by the RetrieVault configuration.
+func (r *RetrieVault) checkAuth(auth *Auth) error {
+	if auth != nil && auth.Method == certAuth && r.ClientCertPath == "" && env.GetOrElse(api.EnvVaultClientCert, "") == "" {
+		err := fmt.Errorf("A client certificate must be configured in order to use the cert authentication method")
+		log.Msg.WithField("msg", err.Error()).Error("Error when logging in to Vault")
+		return err
+	}
+	return nil
+}
+
+// newClient creates a Vault client from the given configuration.
+func newClient(config *api.Config) (*api.Client, error) {
+	client, err := api.NewClient(config)
+	if err != nil {
+		log.Msg.WithFields(logrus.Fields{
+			"msg":    err.Error(),
+			"config": config,
+		}).Error("Error when creating Vault client from configuration")
+		return nil, err
+	}
+	return client, nil
+}
+
+// setupIdentities sets up the default identity, and a dedicated one for each
+// distinct set of credentials configured in secrets. All of their clients
+// are created from the given configuration.
+func (r *RetrieVault) setupIdentities(config *api.Config) error {
+	if err := r.checkAuth(r.Auth); err != nil {
+		return err
+	}
+	client, err := newClient(config)
+	if err != nil {
+		return err
+	}
+	tokens, err := newTokenManager(client, r.Auth)
+	if err != nil {
+		return err
+	}
+	unwrapped := false
+	if r.WrappedToken != "" || r.WrappedTokenFile != "" || r.WrappedTokenEnv != "" {
+		wrappingToken, err := readCredential("wrapped_token", r.WrappedToken, r.WrappedTokenFile, r.WrappedTokenEnv)
+		if err != nil {
+			log.Msg.WithField("msg", err.Error()).Error("Error when reading the response-wrapping token")
+			return err
+		}
+		if unwrapped, err = tokens.bootstrap(wrappingToken); err != nil {
+			log.Msg.WithField("msg", err.Error()).Error("Error when unwrapping the response-wrapping token")
+			return err
+		}
+	}
+	switch {
+	case unwrapped:
+		// The token has been taken from the response-wrapping token
+	case r.Auth != nil:
+		if err := tokens.login(); err != nil {
+			return err
+		}
+	case env.GetOrElse("VAULT_TOKEN", "") == "" && r.VaultToken != "":
+		tokens.setToken(r.VaultToken)
+	}
+	tokens.lookup()
+	r.identity = &identity{client: client, tokens: tokens}
+
+	r.identities = make(map[*Secret]*identity)
+	byKey := make(map[string]*identity)
+	for _, secret := range r.Secrets {
+		key, token, err := secret.credentials()
+		if err != nil {
+			log.Msg.WithFields(logrus.Fields{
+				"msg":        err.Error(),
+				"vault_path": secret.VaultPath,
+			}).Error("Error when reading the credentials of the secret")
+			return err
+		}
+		if key == "" {
+			continue
+		}
+		if id, ok := byKey[key]; ok {
+			r.identities[secret] = id
+			continue
+		}
+		if err := r.checkAuth(secret.Auth); err != nil {
+			return err
+		}
+		id, err := newIdentity(config, token, secret.Auth)
+		if err != nil {
+			return err
+		}
+		byKey[key] = id
+		r.identities[secret] = id
+	}
+	return nil
+}
+
+// newIdentity creates an identity with a client created from config, which
+// either uses the given token or logs in with auth.
+func newIdentity(config *api.Config, token string, auth *Auth) (*identity, error) {
+	client, err := newClient(config)
+	if err != nil {
+		return nil, err
+	}
+	client.ClearToken()
+	tokens, err := newTokenManager(client, auth)
+	if err != nil {
+		return nil, err
+	}
+	if auth != nil {
+		if err := tokens.login(); err != nil {
+			return nil, err
+		}
+	} else {
+		tokens.setToken(token)
+	}
+	tokens.lookup()
+	return &identity{client: client, tokens: tokens}, nil
+}
+
+// use calls f with the client of the identity, making sure that its token
+// isn't swapped meanwhile.
+func (id *identity) use(f func(client *api.Client)) {
+	id.tokens.mu.RLock()
+	defer id.tokens.mu.RUnlock()
+	f(id.client)
+}
+
+// identityOf returns the identity used to fetch the given secret.
+func (r *RetrieVault) identityOf(secret *Secret) *identity {
+	if id, ok := r.identities[secret]; ok {
+		return id
+	}
+	return r.identity
+}
+
+// distinctIdentities returns every identity in use, without duplicates.
+func (r *RetrieVault) distinctIdentities() []*identity {
+	ids := []*identity{r.identity}
+	seen := map[*identity]bool{r.identity: true}
+	for _, secret := range r.Secrets {
+		if id := r.identityOf(secret); !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// credentials returns a key which identifies the credentials configured for
+// the secret, along with its token, if any. The key is empty if the secret
+// has no credentials of its own.
+func (s *Secret) credentials() (string, string, error) {
+	if s.Auth != nil {
+		key, err := json.Marshal(s.Auth)
+		if err != nil {
+			return "", "", err
+		}
+		return fmt.Sprintf("auth:%s", key), "", nil
+	}
+	if s.Token == "" && s.TokenFile == "" {
+		return "", "", nil
+	}
+	token, err := readCredential("token", s.Token, s.TokenFile, "")
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("token:%s", token), token, nil
+}
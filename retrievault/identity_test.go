@@ -0,0 +1,44 @@
+package retrievault
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestSetupIdentities(t *testing.T) {
+	config, _, stop := testVaultConfig(map[string]interface{}{
+		"/v1/auth/approle/login": map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": "approle-token"},
+		},
+	})
+	defer stop()
+	os.Unsetenv("VAULT_TOKEN")
+
+	auth := &Auth{Method: "approle", Parameters: json.RawMessage(`{"role_id":"role","secret_id":"secret"}`)}
+	r := &RetrieVault{Config: Config{
+		VaultToken: "default-token",
+		Secrets: []*Secret{
+			&Secret{VaultPath: "generic/default"},
+			&Secret{VaultPath: "generic/team-a", Token: "team-a-token"},
+			&Secret{VaultPath: "generic/team-a-too", Token: "team-a-token"},
+			&Secret{VaultPath: "generic/team-b", Auth: auth},
+		},
+	}}
+	if err := r.setupIdentities(config); err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+
+	expected := []string{"default-token", "team-a-token", "team-a-token", "approle-token"}
+	for i, secret := range r.Secrets {
+		if token := r.identityOf(secret).client.Token(); token != expected[i] {
+			t.Error("For", secret.VaultPath, "expected", expected[i], "got", token)
+		}
+	}
+	if r.identityOf(r.Secrets[1]) != r.identityOf(r.Secrets[2]) {
+		t.Error("Expected secrets with the same token to share the same identity")
+	}
+	if ids := r.distinctIdentities(); len(ids) != 3 {
+		t.Error("Expected 3 distinct identities, got", len(ids))
+	}
+}
@@ -0,0 +1,162 @@
+package retrievault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// KV2 fetches a secret from a version 2 key-value backend. Each key of the
+// secret is written in its own file, just like the "generic" type does.
+type KV2 struct {
+
+	// Mount is the path where the backend is mounted. If not set, the first
+	// element of the Vault path will be taken as default.
+	Mount string `json:"mount,omitempty"`
+
+	// Version is the version of the secret to fetch. If not set, the latest
+	// version is fetched.
+	Version int `json:"version,omitempty"`
+
+	// VersionFile is the file where the version fetched is written, so that
+	// a rollout can be traced to a specific revision of the secret.
+	VersionFile *fileParameters `json:"version_file,omitempty"`
+
+	version int
+	vaultClient
+	Generic
+}
+
+func NewKV2() *KV2 {
+	return new(KV2)
+}
+
+// CurrentVersion returns the version of the last secret fetched.
+func (k *KV2) CurrentVersion() int {
+	return k.version
+}
+
+// dataPath returns the path to read the secret at vaultPath from, which is
+// under the "data/" prefix of the mount. Paths under the "metadata/" prefix,
+// or already under the "data/" one, are also accepted.
+func (k *KV2) dataPath(vaultPath string) (string, error) {
+	vaultPath = strings.Trim(vaultPath, "/")
+	mount := strings.Trim(k.Mount, "/")
+	if mount == "" {
+		mount = strings.SplitN(vaultPath, "/", 2)[0]
+	}
+	if !strings.HasPrefix(vaultPath, mount+"/") {
+		return "", fmt.Errorf("Vault path %s is not under mount %s", vaultPath, mount)
+	}
+	key := strings.TrimPrefix(vaultPath, mount+"/") + "/"
+	for _, prefix := range []string{"data/", "metadata/"} {
+		key = strings.TrimPrefix(key, prefix)
+	}
+	key = strings.TrimSuffix(key, "/")
+	if key == "" {
+		return "", fmt.Errorf("No secret specified in Vault path %s", vaultPath)
+	}
+	return fmt.Sprintf("%s/data/%s", mount, key), nil
+}
+
+// read reads the secret at dataPath, pinned to Version if set.
+func (k *KV2) read(client *api.Client, dataPath string) (*api.Secret, error) {
+	r := client.NewRequest("GET", "/v1/"+dataPath)
+	if k.Version > 0 {
+		r.Params.Set("version", strconv.Itoa(k.Version))
+	}
+	resp, err := client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if resp != nil && resp.StatusCode == 404 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return api.ParseSecret(resp.Body)
+}
+
+// stringData converts the values of a KV v2 secret to strings. Values which
+// aren't strings are encoded as JSON.
+func stringData(data map[string]interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		if s, ok := value.(string); ok {
+			result[key] = s
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = string(encoded)
+	}
+	return result, nil
+}
+
+func (k *KV2) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
+	dataPath, err := k.dataPath(vaultPath)
+	if err != nil {
+		e <- err
+		return
+	}
+	log.Msg.WithFields(logrus.Fields{
+		"vault_path": dataPath,
+		"version":    k.Version,
+	}).Debug("Fetching secret at path")
+	raw, err := k.rawClient()
+	if err != nil {
+		e <- err
+		return
+	}
+	secret, err := k.read(raw, dataPath)
+	if err != nil {
+		e <- err
+		return
+	}
+	if secret == nil {
+		e <- fmt.Errorf("No secret found at path %s", dataPath)
+		return
+	}
+	data, _ := secret.Data["data"].(map[string]interface{})
+	metadata, _ := secret.Data["metadata"].(map[string]interface{})
+	version, _ := intValue(metadata["version"])
+	if data == nil {
+		e <- fmt.Errorf("Version %d of secret %s has been deleted or destroyed", version, dataPath)
+		return
+	}
+	if data, err = stringData(data); err != nil {
+		e <- err
+		return
+	}
+	k.version = version
+	k.secret = secret
+	log.Msg.WithFields(logrus.Fields{
+		"vault_path": dataPath,
+		"version":    version,
+	}).Info("Fetched secret version")
+
+	if k.VersionFile != nil {
+		file, perm, err := k.getDestAndPerms("version", *k.VersionFile, dest)
+		if err != nil {
+			e <- err
+			return
+		}
+		er := make(chan error, 1)
+		k.writeInFile(file, []byte(strconv.Itoa(version)), perm, er)
+		if err := <-er; err != nil {
+			log.Msg.Error("Error when writing secret version to file")
+			e <- err
+			return
+		}
+	}
+	k.writeKeys(ctx, data, dest, e)
+}
@@ -0,0 +1,113 @@
+package retrievault
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type testkv2path struct {
+	mount     string
+	vaultPath string
+	expected  string
+	e         bool
+}
+
+var testkv2paths = []*testkv2path{
+	&testkv2path{"", "secret/app", "secret/data/app", false},
+	&testkv2path{"", "/secret/data/app", "secret/data/app", false},
+	&testkv2path{"", "secret/metadata/app/db", "secret/data/app/db", false},
+	&testkv2path{"kv/team", "kv/team/app", "kv/team/data/app", false},
+	&testkv2path{"kv", "secret/app", "", true},
+	&testkv2path{"", "secret/data/", "", true},
+}
+
+func TestKV2DataPath(t *testing.T) {
+	for _, pair := range testkv2paths {
+		k := &KV2{Mount: pair.mount}
+		dataPath, err := k.dataPath(pair.vaultPath)
+		if pair.e {
+			if err == nil {
+				t.Error("For", pair.vaultPath,
+					"expected non nil error",
+					"got nil error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error("For", pair.vaultPath, "expected nil error", "got", err)
+		} else if dataPath != pair.expected {
+			t.Error("For", pair.vaultPath, "expected", pair.expected, "got", dataPath)
+		}
+	}
+}
+
+func TestKV2FetchSecret(t *testing.T) {
+	client, requests, stop := testVault(t, map[string]interface{}{
+		"/v1/secret/data/app": map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     map[string]interface{}{"user": "admin", "port": 5432},
+				"metadata": map[string]interface{}{"version": 3},
+			},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	k := &KV2{Version: 3, VersionFile: &fileParameters{}}
+	k.SetClient(client)
+	e := make(chan error, 1)
+	k.FetchSecret(context.Background(), "secret/app", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if req := (*requests)[0]; req.path != "/v1/secret/data/app" || req.query != "version=3" {
+		t.Error("Expected a request to /v1/secret/data/app?version=3, got", req.path+"?"+req.query)
+	}
+	files := map[string]string{"user": "admin", "port": "5432", "version": "3"}
+	for file, expected := range files {
+		content, _ := ioutil.ReadFile(path.Join(dir, file))
+		if string(content) != expected {
+			t.Error("For", file, "expected", expected, "got", string(content))
+		}
+	}
+	if k.CurrentVersion() != 3 {
+		t.Error("Expected version", 3, "got", k.CurrentVersion())
+	}
+}
+
+func TestKV2FetchDeletedSecret(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/secret/data/app": map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     nil,
+				"metadata": map[string]interface{}{"version": 2, "deletion_time": "2018-03-22T02:24:06Z"},
+			},
+		},
+	})
+	defer stop()
+	k := NewKV2()
+	k.SetClient(client)
+	e := make(chan error, 1)
+	k.FetchSecret(context.Background(), "secret/app", "", client.Logical(), e)
+	if err := <-e; err == nil {
+		t.Error("Expected non nil error for a deleted secret, got nil error")
+	}
+}
+
+func TestKV2FetchSecretWithoutClient(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{})
+	defer stop()
+	k := NewKV2()
+	e := make(chan error, 1)
+	k.FetchSecret(context.Background(), "secret/app", "", client.Logical(), e)
+	if err := <-e; err == nil {
+		t.Error("Expected non nil error without a client set, got nil error")
+	}
+}
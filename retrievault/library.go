@@ -0,0 +1,204 @@
+package retrievault
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// Option configures a RetrieVault created with New.
+type Option func(*RetrieVault)
+
+// InMemory makes the RetrieVault keep the secrets fetched in memory, and
+// return them in the Result of Fetch, instead of writing them on disk. Hooks
+// are not run, trust directories are not updated and trees are not pruned.
+// Secret types registered with RegisterType write their own files, so they
+// aren't supported in this mode.
+func InMemory() Option {
+	return func(r *RetrieVault) {
+		r.inMemory = true
+	}
+}
+
+// WithVaultConfig makes the RetrieVault create its Vault clients from the
+// given configuration, e.g. to use a custom HTTP client. The TLS settings and
+// the address of the Config, and the environment variables of Vault, are
+// ignored.
+func WithVaultConfig(config *api.Config) Option {
+	return func(r *RetrieVault) {
+		r.vaultConfig = config
+	}
+}
+
+// New creates a RetrieVault which fetches the secrets of config, and logs in
+// to Vault with its credentials. Unlike SetupApp, it leaves the logging
+// configuration untouched.
+func New(config Config, opts ...Option) (*RetrieVault, error) {
+	r := &RetrieVault{Config: config}
+	for _, opt := range opts {
+		opt(r)
+	}
+	vaultConfig, err := r.vaultClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.setupIdentities(vaultConfig); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Result holds the outcome of fetching every secret of a RetrieVault.
+type Result struct {
+
+	// Secrets holds the outcome of each secret, in the same order as
+	// Config.Secrets
+	Secrets []*SecretResult
+}
+
+// SecretResult is the outcome of fetching a single secret.
+type SecretResult struct {
+
+	// Secret is the configuration of the secret
+	Secret *Secret
+
+	// Err is the error encountered when fetching the secret, if any
+	Err error
+
+	// Changed reports whether any of the files of the secret changed. It is
+	// always false for secret types which don't report it.
+	Changed bool
+
+	// Lease is the Vault secret fetched, for the secret types which keep
+	// track of its lease
+	Lease *api.Secret
+
+	// Files holds the content of the files of the secret, by path, in the
+	// in-memory mode
+	Files map[string][]byte
+}
+
+// Err returns an error summing up the errors of every secret, or nil if all
+// of them were fetched successfully.
+func (r Result) Err() error {
+	var errs []string
+	for _, secret := range r.Secrets {
+		if secret.Err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", secret.Secret.VaultPath, secret.Err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Fetch fetches every secret concurrently, and returns the outcome of each of
+// them. The error returned is the one of Result.Err.
+func (r *RetrieVault) Fetch(ctx context.Context) (Result, error) {
+	result, _, _ := r.fetch(ctx, ctx, false)
+	return result, result.Err()
+}
+
+// memoryKeeper is implemented by the retrievers which embed a writer, so that
+// they can keep their files in memory.
+type memoryKeeper interface {
+	keepInMemory()
+	memoryFiles() map[string][]byte
+}
+
+// fetch fetches every secret concurrently, and returns the outcome of each of
+// them along with the retrievers used, in the same order as r.Secrets, and
+// the first error encountered. The hooks of the secrets that changed are run
+// with hookCtx, once they have been fetched. If failFast is set, the first
+// error cancels the secrets still being fetched, and no more hooks are run.
+func (r *RetrieVault) fetch(ctx, hookCtx context.Context, failFast bool) (Result, []Retriever, error) {
+	type outcome struct {
+		index int
+		err   error
+	}
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	aborted := make(chan struct{})
+	done := make(chan outcome)
+	var first error
+	fail := func(err error) {
+		if first != nil {
+			return
+		}
+		first = err
+		if failFast {
+			close(aborted)
+			cancel()
+		}
+	}
+	result := Result{Secrets: make([]*SecretResult, len(r.Secrets))}
+	retrievers := make([]Retriever, len(r.Secrets))
+	started := 0
+	for i, secret := range r.Secrets {
+		result.Secrets[i] = &SecretResult{Secret: secret}
+		select {
+		case <-aborted:
+			result.Secrets[i].Err = context.Canceled
+			continue
+		default:
+		}
+		retr, err := r.newRetriever(secret)
+		if err == nil && r.inMemory {
+			if keeper, ok := retr.(memoryKeeper); ok {
+				keeper.keepInMemory()
+			} else {
+				err = fmt.Errorf("Secret type %s can't be kept in memory", secret.Type)
+			}
+		}
+		if err != nil {
+			result.Secrets[i].Err = err
+			fail(err)
+			continue
+		}
+		retrievers[i] = retr
+		started++
+		go func(i int, secret *Secret, retr Retriever) {
+			e := make(chan error, 1)
+			r.fetchSecret(fetchCtx, secret, retr, e)
+			err := <-e
+			select {
+			case <-aborted:
+			default:
+				if err == nil {
+					r.runHook(hookCtx, secret, retr)
+				}
+			}
+			done <- outcome{i, err}
+		}(i, secret, retr)
+	}
+
+	for ; started > 0; started-- {
+		o := <-done
+		secret := result.Secrets[o.index]
+		retr := retrievers[o.index]
+		if o.err != nil {
+			log.Msg.WithFields(logrus.Fields{
+				"msg":        o.err.Error(),
+				"vault_path": secret.Secret.VaultPath,
+			}).Error("Error when fetching secret")
+			secret.Err = o.err
+			fail(o.err)
+			continue
+		}
+		if reporter, ok := retr.(ChangeReporter); ok {
+			secret.Changed = reporter.Changed()
+		}
+		if leaser, ok := retr.(Leaser); ok {
+			secret.Lease = leaser.Lease()
+		}
+		if keeper, ok := retr.(memoryKeeper); ok && r.inMemory {
+			secret.Files = keeper.memoryFiles()
+		}
+	}
+	return result, retrievers, first
+}
@@ -0,0 +1,174 @@
+package retrievault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestFetchInMemory(t *testing.T) {
+	config, _, stop := testVaultConfig(map[string]interface{}{
+		"/v1/secret/app": map[string]interface{}{
+			"lease_duration": 3600,
+			"data":           map[string]interface{}{"password": "s3cr3t"},
+		},
+	})
+	defer stop()
+	os.Unsetenv("VAULT_TOKEN")
+
+	dir := path.Join(os.TempDir(), "retrievault-in-memory")
+	r, err := New(Config{
+		VaultToken: "library-token",
+		Secrets: []*Secret{
+			&Secret{Type: generic, Path: dir, VaultPath: "secret/app"},
+			&Secret{Type: generic, Path: dir, VaultPath: "secret/missing"},
+			&Secret{Type: "unknown", Path: dir, VaultPath: "secret/app"},
+		},
+	}, WithVaultConfig(config), InMemory())
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	result, err := r.Fetch(context.Background())
+	if err == nil {
+		t.Error("Expected an error for the secrets which failed, got nil")
+	}
+	if len(result.Secrets) != 3 {
+		t.Fatal("Expected", 3, "secret results, got", len(result.Secrets))
+	}
+
+	app := result.Secrets[0]
+	if app.Err != nil || !app.Changed {
+		t.Error("For", app.Secret.VaultPath, "expected a changed secret without error, got", app.Err)
+	}
+	if data := string(app.Files[path.Join(dir, "password")]); data != "s3cr3t" {
+		t.Error("For", app.Secret.VaultPath, "expected", "s3cr3t", "got", data)
+	}
+	if app.Lease == nil || app.Lease.LeaseDuration != 3600 {
+		t.Error("For", app.Secret.VaultPath, "expected a lease of", 3600, "got", app.Lease)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("Expected nothing written on disk, got", err)
+	}
+	for _, secret := range result.Secrets[1:] {
+		if secret.Err == nil {
+			t.Error("For", secret.Secret.VaultPath, "expected error, got nil")
+		}
+	}
+}
+
+func TestFetchInMemoryIgnoresDisk(t *testing.T) {
+	ca, caKey, caPEM, _ := testCertificate(t, "ca", nil, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), nil, nil)
+	_, _, issuedPEM, issuedKeyPEM := testCertificate(t, "web", []string{"web"}, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), ca, caKey)
+	config, requests, stop := testVaultConfig(map[string]interface{}{
+		"/v1/pki/issue/web": map[string]interface{}{
+			"data": map[string]interface{}{
+				"certificate": string(issuedPEM),
+				"private_key": string(issuedKeyPEM),
+				"issuing_ca":  string(caPEM),
+			},
+		},
+		"/v1/pki/cert/ca": map[string]interface{}{
+			"data": map[string]interface{}{"certificate": string(caPEM)},
+		},
+	})
+	defer stop()
+	os.Unsetenv("VAULT_TOKEN")
+
+	// A valid certificate is already in the destination, from another run
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, _, currentPEM, currentKeyPEM := testCertificate(t, "web", []string{"web"}, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), ca, caKey)
+	ioutil.WriteFile(path.Join(dir, "cert.crt"), currentPEM, 0644)
+	ioutil.WriteFile(path.Join(dir, "cert.key"), currentKeyPEM, 0600)
+
+	r, err := New(Config{
+		VaultToken: "library-token",
+		Secrets: []*Secret{
+			&Secret{Type: certs, Path: dir, VaultPath: "pki/issue/web", Parameters: json.RawMessage(`{"common_name":"web","alt_names":["web"],"ip_sans":["10.0.0.1"]}`)},
+		},
+	}, WithVaultConfig(config), InMemory())
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	result, err := r.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+
+	issued := false
+	for _, req := range *requests {
+		issued = issued || req.path == "/v1/pki/issue/web"
+	}
+	if !issued {
+		t.Error("Expected a new certificate to be issued")
+	}
+	files := result.Secrets[0].Files
+	if data := files[path.Join(dir, "cert.crt")]; !bytes.HasPrefix(data, issuedPEM) {
+		t.Error("Expected the certificate issued in memory, got", string(data))
+	}
+	if data := files[path.Join(dir, "cert.key")]; !bytes.HasPrefix(data, issuedKeyPEM) {
+		t.Error("Expected the private key issued in memory, got", string(data))
+	}
+	if data, _ := ioutil.ReadFile(path.Join(dir, "cert.crt")); string(data) != string(currentPEM) {
+		t.Error("Expected the certificate on disk to be left untouched")
+	}
+}
+
+func TestFetchSecretsFailFast(t *testing.T) {
+	// A secret doesn't answer until the end of the test
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/secret/slow" {
+			<-release
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[]}`))
+	}))
+	defer server.Close()
+	defer close(release)
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	os.Unsetenv("VAULT_TOKEN")
+
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := New(Config{
+		VaultToken: "library-token",
+		Secrets: []*Secret{
+			&Secret{Type: generic, Path: dir, VaultPath: "secret/slow"},
+			&Secret{Type: generic, Path: dir, VaultPath: "secret/missing"},
+		},
+	}, WithVaultConfig(config))
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+
+	// The first error is returned, without waiting for the slow secret
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	err = r.FetchSecrets(ctx)
+	if err == nil || !strings.Contains(err.Error(), "secret/missing") {
+		t.Error("Expected the error of", "secret/missing", "got", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Error("Expected the slow secret to be cancelled, took", elapsed)
+	}
+}
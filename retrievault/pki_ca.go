@@ -0,0 +1,178 @@
+package retrievault
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// PKICA fetches the CA certificate, the CA chain and the CRL of the PKI
+// backend mounted at the Vault path, without issuing any certificate. These
+// endpoints don't require authentication. The CA can also be installed in a
+// system trust directory.
+type PKICA struct {
+
+	// CA is the destination of the CA certificate
+	CA fileParameters `json:"ca,omitempty"`
+
+	// CAChain is the destination of the CA chain. It is only fetched if set,
+	// and written empty if the CA has no chain.
+	CAChain *fileParameters `json:"ca_chain,omitempty"`
+
+	// CRL is the destination of the CRL. It is only fetched if set.
+	CRL *fileParameters `json:"crl,omitempty"`
+
+	// TrustDir is the system trust directory where the CA is installed, e.g.
+	// "/usr/local/share/ca-certificates"
+	TrustDir string `json:"trust_dir,omitempty"`
+
+	// TrustFile is the name of the CA in TrustDir. If not set, the mount of
+	// the PKI backend followed by ".crt" will be taken as default.
+	TrustFile string `json:"trust_file,omitempty"`
+
+	// UpdateCommand is the command run once the CA installed in TrustDir has
+	// changed, e.g. ["update-ca-certificates"]
+	UpdateCommand []string `json:"update_command,omitempty"`
+
+	// UpdateTimeout is the maximum time UpdateCommand may run. If not set,
+	// "30s" will be taken as default.
+	UpdateTimeout string `json:"update_timeout,omitempty"`
+
+	vaultClient
+	writer
+}
+
+func NewPKICA() *PKICA {
+	return new(PKICA)
+}
+
+// readRaw reads an endpoint which doesn't answer in JSON, like those that
+// return PEM data. nil is returned if it doesn't exist.
+func readRaw(client *api.Client, vaultPath string) ([]byte, error) {
+	r := client.NewRequest("GET", "/v1/"+vaultPath)
+	resp, err := client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if resp != nil && resp.StatusCode == 404 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// install writes the CA in the trust directory and, if it changed, runs the
+// update command.
+func (p *PKICA) install(ctx context.Context, mount string, ca []byte) error {
+	name := p.TrustFile
+	if name == "" {
+		name = strings.Replace(mount, "/", "-", -1) + ".crt"
+	}
+	trust := new(writer)
+	er := make(chan error, 1)
+	trust.writeInFile(path.Join(p.TrustDir, name), ca, 0644, er)
+	if err := <-er; err != nil {
+		return err
+	}
+	if !trust.Changed() {
+		return nil
+	}
+	p.setChanged()
+	log.Msg.WithField("file", path.Join(p.TrustDir, name)).Info("CA installed in trust directory")
+	if len(p.UpdateCommand) == 0 {
+		return nil
+	}
+	update := &OnChange{Command: p.UpdateCommand, Timeout: p.UpdateTimeout}
+	return update.runCommand(ctx)
+}
+
+func (p *PKICA) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
+	raw, err := p.rawClient()
+	if err != nil {
+		e <- err
+		return
+	}
+	mount := strings.Trim(vaultPath, "/")
+	type output struct {
+		name        string
+		endpoint    string
+		defaultFile string
+		params      *fileParameters
+	}
+	outputs := []output{{"ca", "ca/pem", "ca.crt", &p.CA}}
+	if p.CAChain != nil {
+		outputs = append(outputs, output{"ca_chain", "ca_chain", "ca_chain.crt", p.CAChain})
+	}
+	if p.CRL != nil {
+		outputs = append(outputs, output{"crl", "crl/pem", "crl.pem", p.CRL})
+	}
+
+	var (
+		files []*fileContent
+		ca    []byte
+	)
+	for _, o := range outputs {
+		endpoint := fmt.Sprintf("%s/%s", mount, o.endpoint)
+		log.Msg.WithField("vault_path", endpoint).Debug("Fetching secret at path")
+		data, err := readRaw(raw, endpoint)
+		if err != nil {
+			e <- err
+			return
+		}
+		// The chain is empty when the CA is a root CA, and is written as an
+		// empty file
+		if len(data) == 0 && o.name != "ca_chain" {
+			e <- fmt.Errorf("No %s found at path %s", o.name, endpoint)
+			return
+		}
+		if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+			data = append(data, '\n')
+		}
+		if o.name == "ca" {
+			ca = data
+		}
+		file, perm, err := p.getDestAndPerms(o.defaultFile, *o.params, dest)
+		if err != nil {
+			log.Msg.WithFields(logrus.Fields{
+				"secret":      o.name,
+				"permissions": perm,
+			}).Error(err.Error())
+			e <- err
+			return
+		}
+		files = append(files, &fileContent{path: file, data: data, perm: perm})
+	}
+
+	er := make(chan error, 1)
+	go p.writeInFiles(files, er)
+	select {
+	case <-ctx.Done():
+		log.Msg.Error("Parent context cancelled")
+		e <- ctx.Err()
+		return
+	case err := <-er:
+		if err != nil {
+			log.Msg.Error("Error when writing secret to file")
+			e <- err
+			return
+		}
+	}
+
+	if p.TrustDir != "" && !p.inMemory() {
+		if err := p.install(ctx, mount, ca); err != nil {
+			log.Msg.WithField("msg", err.Error()).Error("Error when installing CA in trust directory")
+			e <- err
+			return
+		}
+	}
+	e <- nil
+	return
+}
@@ -0,0 +1,99 @@
+package retrievault
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPKICAFetchSecret(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/pki/ca/pem":   []byte("ca"),
+		"/v1/pki/ca_chain": []byte("intermediate\nca\n"),
+		"/v1/pki/crl/pem":  []byte("crl"),
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trustDir := path.Join(dir, "trust")
+	marker := path.Join(dir, "updated")
+
+	p := &PKICA{
+		CAChain:       &fileParameters{},
+		CRL:           &fileParameters{Path: "internal.crl"},
+		TrustDir:      trustDir,
+		UpdateCommand: []string{"touch", marker},
+	}
+	p.SetClient(client)
+	e := make(chan error, 1)
+	p.FetchSecret(context.Background(), "pki", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	files := map[string]string{
+		"ca.crt":        "ca\n",
+		"ca_chain.crt":  "intermediate\nca\n",
+		"internal.crl":  "crl\n",
+		"trust/pki.crt": "ca\n",
+	}
+	for file, expected := range files {
+		content, _ := ioutil.ReadFile(path.Join(dir, file))
+		if string(content) != expected {
+			t.Error("For", file, "expected", expected, "got", string(content))
+		}
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Error("Expected the update command to run, got", err)
+	}
+
+	// The update command only runs when the CA installed changes
+	os.Remove(marker)
+	p = &PKICA{TrustDir: trustDir, UpdateCommand: []string{"touch", marker}}
+	p.SetClient(client)
+	p.FetchSecret(context.Background(), "pki", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("Expected the update command not to run")
+	}
+}
+
+func TestPKICAFetchSecretRootCA(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/pki/ca/pem":   []byte("ca"),
+		"/v1/pki/ca_chain": []byte(""),
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A root CA has no chain, which is written as an empty file
+	p := &PKICA{CAChain: &fileParameters{}}
+	p.SetClient(client)
+	e := make(chan error, 1)
+	p.FetchSecret(context.Background(), "pki", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	content, err := ioutil.ReadFile(path.Join(dir, "ca_chain.crt"))
+	if err != nil || len(content) != 0 {
+		t.Error("Expected an empty CA chain, got", string(content), err)
+	}
+
+	// The CA itself is still required
+	p = &PKICA{}
+	p.SetClient(client)
+	p.FetchSecret(context.Background(), "pki2", dir, client.Logical(), e)
+	if err := <-e; err == nil {
+		t.Error("Expected an error when there is no CA")
+	}
+}
@@ -0,0 +1,214 @@
+package retrievault
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// DefaultPluginTimeout is the maximum time a plugin may run, if no other
+// timeout is configured.
+const DefaultPluginTimeout = "1m"
+
+// Plugin is a secret type implemented by an external program, so that it can
+// be written in any language. The program is run every time the secret is
+// fetched. It reads a JSON pluginRequest from stdin, fetches the secret from
+// Vault with the address and token given, and writes a JSON pluginResponse to
+// stdout, holding the files to write and, optionally, the lease of the
+// secret. Anything written to stderr is logged if it fails.
+type Plugin struct {
+
+	// Command is the program to run, along with its arguments
+	Command []string `json:"command"`
+
+	// Timeout is the maximum time the program may run. If not set, "1m" will
+	// be taken as default.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// pluginRequest is the request sent to a plugin.
+type pluginRequest struct {
+	Type       string          `json:"type"`
+	VaultPath  string          `json:"vault_path"`
+	Path       string          `json:"path"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+	VaultAddr  string          `json:"vault_addr"`
+	VaultToken string          `json:"vault_token"`
+}
+
+// pluginResponse is the response of a plugin. If Error is set, the fetch
+// fails with it and nothing is written.
+type pluginResponse struct {
+	Files []*pluginFile `json:"files"`
+	Lease *api.Secret   `json:"lease,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// pluginFile is a file to write, at a path relative to the destination of the
+// secret unless it is absolute. Data is base64 encoded if Encoding is
+// "base64".
+type pluginFile struct {
+	Path     string `json:"path"`
+	Perm     string `json:"perm,omitempty"`
+	Data     string `json:"data"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// pluginRetriever fetches a secret by running a plugin.
+type pluginRetriever struct {
+	name       string
+	plugin     *Plugin
+	parameters json.RawMessage
+	secret     *api.Secret
+	vaultClient
+	writer
+}
+
+func newPluginRetriever(name string, plugin *Plugin, parameters json.RawMessage) *pluginRetriever {
+	return &pluginRetriever{name: name, plugin: plugin, parameters: parameters}
+}
+
+// Lease returns the lease returned by the last run of the plugin, if any.
+func (p *pluginRetriever) Lease() *api.Secret {
+	return p.secret
+}
+
+// run runs the plugin with the given request and decodes its response.
+func (p *pluginRetriever) run(ctx context.Context, request *pluginRequest) (*pluginResponse, error) {
+	if len(p.plugin.Command) == 0 {
+		return nil, fmt.Errorf("No command set for plugin %s", p.name)
+	}
+	timeout := p.plugin.Timeout
+	if timeout == "" {
+		timeout = DefaultPluginTimeout
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, err
+	}
+	input, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	cmdCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(cmdCtx, p.plugin.Command[0], p.plugin.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	fields := logrus.Fields{
+		"plugin": p.name,
+		"stderr": strings.TrimSpace(stderr.String()),
+	}
+	if cmdCtx.Err() == context.DeadlineExceeded {
+		log.Msg.WithFields(fields).Error("Plugin timed out")
+		return nil, fmt.Errorf("Plugin %s timed out after %s", p.name, timeout)
+	}
+	if err != nil {
+		log.Msg.WithFields(fields).Error("Plugin failed")
+		return nil, fmt.Errorf("Plugin %s failed: %s", p.name, err)
+	}
+	response := new(pluginResponse)
+	if err := json.Unmarshal(stdout.Bytes(), response); err != nil {
+		return nil, fmt.Errorf("Unable to decode the response of plugin %s: %s", p.name, err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("Plugin %s failed: %s", p.name, response.Error)
+	}
+	return response, nil
+}
+
+// vaultAddr returns the address of the Vault server the client talks to.
+func vaultAddr(client *api.Client) string {
+	r := client.NewRequest("GET", "/")
+	return (&url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host}).String()
+}
+
+func (p *pluginRetriever) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
+	log.Msg.WithFields(logrus.Fields{
+		"vault_path": vaultPath,
+		"plugin":     p.name,
+	}).Debug("Fetching secret with plugin")
+	raw, err := p.rawClient()
+	if err != nil {
+		e <- err
+		return
+	}
+	response, err := p.run(ctx, &pluginRequest{
+		Type:       p.name,
+		VaultPath:  vaultPath,
+		Path:       dest,
+		Parameters: p.parameters,
+		VaultAddr:  vaultAddr(raw),
+		VaultToken: raw.Token(),
+	})
+	if err != nil {
+		e <- err
+		return
+	}
+	if len(response.Files) == 0 {
+		e <- fmt.Errorf("No files returned by plugin %s", p.name)
+		return
+	}
+	p.secret = response.Lease
+
+	var files []*fileContent
+	for _, f := range response.Files {
+		if f.Path == "" {
+			e <- fmt.Errorf("File without path returned by plugin %s", p.name)
+			return
+		}
+		data := []byte(f.Data)
+		switch f.Encoding {
+		case "":
+		case "base64":
+			if data, err = base64.StdEncoding.DecodeString(f.Data); err != nil {
+				e <- fmt.Errorf("Unable to decode file %s returned by plugin %s: %s", f.Path, p.name, err)
+				return
+			}
+		default:
+			e <- fmt.Errorf("Invalid encoding %s of file %s returned by plugin %s", f.Encoding, f.Path, p.name)
+			return
+		}
+		file, perm, err := p.getDestAndPerms(f.Path, fileParameters{Path: f.Path, Perm: f.Perm}, dest)
+		if err != nil {
+			log.Msg.WithFields(logrus.Fields{
+				"plugin":      p.name,
+				"permissions": f.Perm,
+			}).Error(err.Error())
+			e <- err
+			return
+		}
+		files = append(files, &fileContent{path: file, data: data, perm: perm})
+	}
+
+	er := make(chan error, 1)
+	go p.writeInFiles(files, er)
+	select {
+	case <-ctx.Done():
+		log.Msg.Error("Parent context cancelled")
+		e <- ctx.Err()
+		return
+	case err := <-er:
+		if err != nil {
+			log.Msg.Error("Error when writing secret to file")
+			e <- err
+			return
+		}
+	}
+	e <- nil
+	return
+}
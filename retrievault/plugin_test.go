@@ -0,0 +1,91 @@
+package retrievault
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestPluginFetchSecret(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{})
+	defer stop()
+	client.SetToken("plugin-token")
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The plugin saves its request and answers with two files, one of them
+	// base64 encoded, and a lease
+	script := `cat > "$0/request.json"; echo '{"files":[{"path":"token","perm":"0600","data":"s3cr3t"},{"path":"bin/key","data":"AAEC","encoding":"base64"}],"lease":{"lease_id":"custom/1234","lease_duration":60}}'`
+	p := newPluginRetriever("custom", &Plugin{Command: []string{"sh", "-c", script, dir}}, json.RawMessage(`{"role":"app"}`))
+	p.SetClient(client)
+	e := make(chan error, 1)
+	p.FetchSecret(context.Background(), "custom/creds/app", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+
+	request := new(pluginRequest)
+	content, _ := ioutil.ReadFile(path.Join(dir, "request.json"))
+	if err := json.Unmarshal(content, request); err != nil {
+		t.Fatal("Expected a valid request, got", err)
+	}
+	if request.VaultPath != "custom/creds/app" || request.Path != dir || request.VaultToken != "plugin-token" ||
+		!strings.HasPrefix(request.VaultAddr, "http://127.0.0.1") || string(request.Parameters) != `{"role":"app"}` {
+		t.Error("Expected the request of the secret, got", string(content))
+	}
+	files := map[string]string{
+		"token":   "s3cr3t",
+		"bin/key": "\x00\x01\x02",
+	}
+	for file, expected := range files {
+		content, _ := ioutil.ReadFile(path.Join(dir, file))
+		if string(content) != expected {
+			t.Error("For", file, "expected", expected, "got", string(content))
+		}
+	}
+	if info, err := os.Stat(path.Join(dir, "token")); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("For", "token", "expected permissions", "0600", "got", info)
+	}
+	if lease := p.Lease(); lease == nil || lease.LeaseID != "custom/1234" || lease.LeaseDuration != 60 {
+		t.Error("Expected lease", "custom/1234", "got", lease)
+	}
+}
+
+type testpluginerror struct {
+	script string
+}
+
+var testpluginerrors = []*testpluginerror{
+	&testpluginerror{`echo '{"error":"role not found"}'`},
+	&testpluginerror{`echo 'not json'`},
+	&testpluginerror{`echo '{"files":[]}'`},
+	&testpluginerror{`echo '{"files":[{"path":"a","data":"!","encoding":"base64"}]}'`},
+	&testpluginerror{`echo 'failing' >&2; exit 1`},
+}
+
+func TestPluginErrors(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range testpluginerrors {
+		p := newPluginRetriever("custom", &Plugin{Command: []string{"sh", "-c", test.script}}, nil)
+		p.SetClient(client)
+		e := make(chan error, 1)
+		p.FetchSecret(context.Background(), "custom/creds/app", dir, client.Logical(), e)
+		if err := <-e; err == nil {
+			t.Error("For", test.script, "expected error, got nil")
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package retrievault
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+)
+
+var (
+	typesMu sync.RWMutex
+	types   = make(map[string]func() Retriever)
+
+	// requireParameters are the built-in types which can't be used without
+	// parameters
+	requireParameters = map[string]bool{
+		certs:        true,
+		templateType: true,
+		transit:      true,
+	}
+)
+
+func init() {
+	RegisterType(aws, func() Retriever { return NewAWS() })
+	RegisterType(cassandra, func() Retriever { return NewCassandra() })
+	RegisterType(certs, func() Retriever { return NewCerts() })
+	RegisterType(consul, func() Retriever { return NewConsul() })
+	RegisterType(database, func() Retriever { return NewDatabase() })
+	RegisterType(generic, func() Retriever { return NewGeneric() })
+	RegisterType(genericTree, func() Retriever { return NewGenericTree() })
+	RegisterType(kv2, func() Retriever { return NewKV2() })
+	RegisterType(pkiCA, func() Retriever { return NewPKICA() })
+	RegisterType(rabbitmq, func() Retriever { return NewRabbitMQ() })
+	RegisterType(sshType, func() Retriever { return NewSSH() })
+	RegisterType(templateType, func() Retriever { return NewTemplate() })
+	RegisterType(transit, func() Retriever { return NewTransit() })
+}
+
+// RegisterType makes a secret type available under the given name, so that
+// programs embedding this package can add their own types. factory must
+// return a new Retriever every time it is called; the parameters of the
+// secret, if any, are unmarshalled into it as JSON. RegisterType panics if
+// name is empty, factory is nil, or a type with that name already exists.
+func RegisterType(name string, factory func() Retriever) {
+	typesMu.Lock()
+	defer typesMu.Unlock()
+	if name == "" || factory == nil {
+		panic("retrievault: RegisterType called with an empty name or a nil factory")
+	}
+	if _, dup := types[name]; dup {
+		panic("retrievault: RegisterType called twice for type " + name)
+	}
+	types[name] = factory
+}
+
+// Types returns the names of the registered secret types, sorted.
+func Types() []string {
+	typesMu.RLock()
+	defer typesMu.RUnlock()
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newRetriever returns a new retriever for the type of the secret, either a
+// registered one or a plugin, with the parameters of the secret.
+func (r *RetrieVault) newRetriever(secret *Secret) (Retriever, error) {
+	typesMu.RLock()
+	factory, registered := types[secret.Type]
+	typesMu.RUnlock()
+	plugin, isPlugin := r.Plugins[secret.Type]
+
+	var retr Retriever
+	switch {
+	case registered && isPlugin:
+		log.Msg.WithField("secret_type", secret.Type).Error("Plugin with the name of a registered type.")
+		return nil, fmt.Errorf("Plugin %s has the name of a registered secret type", secret.Type)
+	case registered:
+		retr = factory()
+	case isPlugin:
+		retr = newPluginRetriever(secret.Type, plugin, secret.Parameters)
+		return retr, nil
+	default:
+		log.Msg.WithField("secret_type", secret.Type).Error("Invalid type.")
+		return nil, fmt.Errorf("Invalid secret type %s", secret.Type)
+	}
+
+	var err error
+	if len(secret.Parameters) != 0 {
+		err = json.Unmarshal(secret.Parameters, retr)
+	} else if requireParameters[secret.Type] {
+		err = fmt.Errorf("Parameters are required for secret type %s", secret.Type)
+	}
+	if err != nil {
+		log.Msg.WithFields(logrus.Fields{
+			"msg":         err.Error(),
+			"secret_type": secret.Type,
+		}).Error("Unable to unmarshall parameters for this secret Type")
+		return nil, err
+	}
+	return retr, nil
+}
@@ -0,0 +1,62 @@
+package retrievault
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+type testRetriever struct {
+	Key string `json:"key"`
+}
+
+func (t *testRetriever) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
+	e <- nil
+}
+
+func TestRegisterType(t *testing.T) {
+	RegisterType("test_registry", func() Retriever { return new(testRetriever) })
+	r := &RetrieVault{}
+	retr, err := r.newRetriever(&Secret{Type: "test_registry", Parameters: json.RawMessage(`{"key":"value"}`)})
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if test, ok := retr.(*testRetriever); !ok || test.Key != "value" {
+		t.Error("Expected a test retriever with key", "value", "got", retr)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic when registering a type twice")
+		}
+	}()
+	RegisterType("test_registry", func() Retriever { return new(testRetriever) })
+}
+
+type testnewretriever struct {
+	secret *Secret
+	err    bool
+}
+
+var testnewretrievers = []*testnewretriever{
+	&testnewretriever{&Secret{Type: generic}, false},
+	&testnewretriever{&Secret{Type: "unknown"}, true},
+	&testnewretriever{&Secret{Type: certs}, true},
+	&testnewretriever{&Secret{Type: "myplugin"}, false},
+	&testnewretriever{&Secret{Type: kv2}, true},
+}
+
+func TestNewRetriever(t *testing.T) {
+	r := &RetrieVault{Config: Config{Plugins: map[string]*Plugin{
+		"myplugin": &Plugin{Command: []string{"true"}},
+		kv2:        &Plugin{Command: []string{"true"}},
+	}}}
+	for _, test := range testnewretrievers {
+		_, err := r.newRetriever(test.secret)
+		if (err != nil) != test.err {
+			t.Error("For", test.secret.Type, "expected error", test.err, "got", err)
+		}
+	}
+}
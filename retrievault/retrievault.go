@@ -4,20 +4,32 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"sync"
 
-	env "github.com/DatioBD/retrievault/utils/environment"
 	"github.com/DatioBD/retrievault/utils/log"
 	"github.com/Sirupsen/logrus"
 	"github.com/hashicorp/vault/api"
 )
 
 const (
-	DefaultConfigFile = "/etc/retrievault/config/config.json"
-	DefaultLogPath    = "/var/log/retrievault.log"
-	DefaultLogLevel   = "info"
-	certs             = "certs"
-	generic           = "generic"
+	DefaultConfigFile      = "/etc/retrievault/config/config.json"
+	DefaultLogPath         = "/var/log/retrievault.log"
+	DefaultLogLevel        = "info"
+	DefaultRenewFraction   = 0.66
+	DefaultRefreshInterval = "5m"
+	aws                    = "aws"
+	cassandra              = "cassandra"
+	certs                  = "certs"
+	consul                 = "consul"
+	database               = "database"
+	generic                = "generic"
+	genericTree            = "generic_tree"
+	kv2                    = "kv2"
+	pkiCA                  = "pki_ca"
+	rabbitmq               = "rabbitmq"
+	sshType                = "ssh"
+	templateType           = "template"
+	transit                = "transit"
 )
 
 // Retriever is an interface that wraps the basic FetchSecret method.
@@ -27,8 +39,85 @@ type Retriever interface {
 	FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error)
 }
 
-// RetrieveVault is a struct which holds the configuration for the application
-type RetrieVault struct {
+// Authenticator is an interface that wraps the basic Login method.
+type Authenticator interface {
+
+	// Login logs in to Vault through the authentication backend mounted at
+	// mount, and returns the secret holding the resulting token.
+	Login(client *api.Client, mount string) (*api.Secret, error)
+}
+
+// Leaser is an interface that wraps the basic Lease method. It is implemented
+// by the retrievers that keep the Vault secret they fetched, so that its lease
+// can be tracked when running as a daemon.
+type Leaser interface {
+
+	// Lease returns the secret fetched by the last call to FetchSecret, or nil
+	// if nothing has been fetched yet.
+	Lease() *api.Secret
+}
+
+// Revoker is an interface that wraps the basic RevokeOnShutdown method. It is
+// implemented by the retrievers whose lease may have to be revoked when the
+// daemon stops.
+type Revoker interface {
+
+	// RevokeOnShutdown reports whether the lease of the secret fetched must
+	// be revoked when the daemon stops.
+	RevokeOnShutdown() bool
+}
+
+// EnvProvider is an interface that wraps the basic Env method. It is
+// implemented by the retrievers that can expose secrets as environment
+// variables.
+type EnvProvider interface {
+
+	// Env returns the environment variables set by the last call to
+	// FetchSecret, by name.
+	Env() map[string]string
+}
+
+// ChangeReporter is an interface that wraps the basic Changed method. It is
+// implemented by the retrievers that know whether the files they wrote had
+// a different content before.
+type ChangeReporter interface {
+
+	// Changed reports whether any file was modified by the last call to
+	// FetchSecret.
+	Changed() bool
+}
+
+// ClientSetter is an interface that wraps the basic SetClient method. It is
+// implemented by the retrievers which need more than the logical backend of
+// the Vault client, e.g. to make raw requests. SetClient is called right
+// before FetchSecret, with the client whose logical backend is given to it.
+type ClientSetter interface {
+
+	// SetClient sets the Vault client to be used by the next call to
+	// FetchSecret.
+	SetClient(client *api.Client)
+}
+
+// vaultClient is embedded by the retrievers which implement ClientSetter.
+type vaultClient struct {
+	client *api.Client
+}
+
+func (c *vaultClient) SetClient(client *api.Client) {
+	c.client = client
+}
+
+// rawClient returns the Vault client set with SetClient.
+func (c *vaultClient) rawClient() (*api.Client, error) {
+	if c.client == nil {
+		return nil, fmt.Errorf("No Vault client set")
+	}
+	return c.client, nil
+}
+
+// Config is a struct which holds the configuration for the application, as
+// read from the configuration file.
+type Config struct {
 
 	// LogLevel is the level for logging
 	LogLevel string `json:"log_level,omitempty"`
@@ -45,6 +134,15 @@ type RetrieVault struct {
 	// Vault server SSL certificate.
 	CACertPath string `json:"ca_cert_path,omitempty"`
 
+	// ClientCertPath is the path to a PEM-encoded client certificate used to
+	// authenticate against the Vault server over TLS. It must be set along
+	// with ClientKeyPath.
+	ClientCertPath string `json:"client_cert_path,omitempty"`
+
+	// ClientKeyPath is the path to the PEM-encoded private key of the client
+	// certificate.
+	ClientKeyPath string `json:"client_key_path,omitempty"`
+
 	// Insecure enables or disables SSL verification
 	Insecure bool `json:"insecure,omitempty"`
 
@@ -57,65 +155,133 @@ type RetrieVault struct {
 	// VaultToken is the Vault token used to retrieve all secrets
 	VaultToken string `json:"vault_token,omitempty"`
 
-	client *api.Logical
+	// Auth is the authentication method used to log in to Vault. If set, it
+	// takes precedence over VaultToken.
+	Auth *Auth `json:"auth,omitempty"`
+
+	// WrappedToken is a single-use response-wrapping token, holding either a
+	// Vault token or the secret_id for the AppRole authentication method. It
+	// can also be read from the file WrappedTokenFile or from the environment
+	// variable WrappedTokenEnv.
+	WrappedToken     string `json:"wrapped_token,omitempty"`
+	WrappedTokenFile string `json:"wrapped_token_file,omitempty"`
+	WrappedTokenEnv  string `json:"wrapped_token_env,omitempty"`
+
+	// RenewFraction is the fraction of the lease duration of a secret after
+	// which its lease is renewed, or the secret fetched again, when running as
+	// a daemon. It must be greater than 0 and lower than 1. If not set, 0.66
+	// will be taken as default.
+	RenewFraction float64 `json:"renew_fraction,omitempty"`
+
+	// RefreshInterval is the interval at which secrets without a lease are
+	// fetched again when running as a daemon. If not set, "5m" will be taken
+	// as default.
+	RefreshInterval string `json:"refresh_interval,omitempty"`
+
+	// Include is a list of globs, relative to the directory of the
+	// configuration file, matching other configuration files whose secrets
+	// are added to Secrets, e.g. "conf.d/*.yaml"
+	Include []string `json:"include,omitempty"`
+
+	// Plugins is a map that has secret types as keys, and the plugins
+	// implementing them as values. See Plugin.
+	Plugins map[string]*Plugin `json:"plugins,omitempty"`
+}
+
+// RetrieVault fetches the secrets of a Config from Vault. It is created with
+// New, or with SetupApp for the command line application.
+type RetrieVault struct {
+	Config
+
+	// vaultConfig is the configuration of the Vault clients, if set with the
+	// WithVaultConfig option
+	vaultConfig *api.Config
+
+	// inMemory keeps the secrets fetched in memory instead of writing them
+	inMemory bool
+
+	// envs holds the environment variables exposed by each secret, and
+	// envUpdates is notified when they change, if set
+	envMu      sync.Mutex
+	envs       map[*Secret]map[string]string
+	envUpdates chan struct{}
+
+	identity   *identity
+	identities map[*Secret]*identity
 }
 
 // Secret is a struct that contains information about how to retrieve
-// a secret from Vault. Type can only be one of: certs, generic.
+// a secret from Vault. Type can only be one of the registered types (aws,
+// cassandra, certs, consul, database, generic, generic_tree, kv2, pki_ca,
+// rabbitmq, ssh, template, transit and those added with RegisterType), or a
+// plugin configured in RetrieVault.Plugins.
 type Secret struct {
 	Type       string          `json:"type"`
 	Path       string          `json:"path"`
 	VaultPath  string          `json:"vault_path"`
 	Parameters json.RawMessage `json:"parameters,omitempty"`
-}
+	OnChange   *OnChange       `json:"on_change,omitempty"`
 
-func (retrievault *RetrieVault) readConfiguration(path string) error {
-	content, err := ioutil.ReadFile(path)
-	if err != nil {
-		return err
-	}
-	err = json.Unmarshal(content, retrievault)
-	if err != nil {
-		return err
-	}
-	return nil
+	// Token, TokenFile and Auth allow to fetch this secret with its own
+	// credentials, instead of the ones of the RetrieVault configuration.
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"token_file,omitempty"`
+	Auth      *Auth  `json:"auth,omitempty"`
 }
 
+// SetupApp reads the configuration file, sets up logging as configured, and
+// creates the RetrieVault of the command line application.
 func SetupApp(configPath, logPath, loglevel string) (*RetrieVault, error) {
-	retrievault := new(RetrieVault)
-	if err := retrievault.readConfiguration(configPath); err != nil {
+	config, err := LoadConfig(configPath)
+	if err != nil {
 		log.Msg.WithField("msg", err.Error()).Error("Error when reading configuration")
 		return nil, err
 	}
 
-	if retrievault.LogFile == "" || logPath != DefaultLogPath {
-		retrievault.LogFile = logPath
+	if config.LogFile == "" || logPath != DefaultLogPath {
+		config.LogFile = logPath
 	}
 
-	if retrievault.LogLevel == "" || loglevel != DefaultLogLevel {
-		retrievault.LogLevel = loglevel
+	if config.LogLevel == "" || loglevel != DefaultLogLevel {
+		config.LogLevel = loglevel
 	}
 
 	// Setting log configuration
-	if err := log.SetLogLevel(retrievault.LogLevel); err != nil {
+	if err := log.SetLogLevel(config.LogLevel); err != nil {
 		log.Msg.WithFields(logrus.Fields{
-			"log_level": retrievault.LogLevel,
+			"log_level": config.LogLevel,
 			"msg":       err.Error(),
 		}).Warn("Error when setting log level.")
 	}
-	if err := log.SetOutput(retrievault.LogFile); err != nil {
+	if err := log.SetOutput(config.LogFile); err != nil {
 		log.Msg.WithFields(logrus.Fields{
-			"log_file": retrievault.LogFile,
+			"log_file": config.LogFile,
 			"msg":      err.Error(),
 		}).Warn("Error when setting log output file.")
 	}
+	return New(config)
+}
 
-	// Setting Vault client configuration
+// vaultClientConfig returns the configuration of the Vault clients: the one
+// set with WithVaultConfig as is, or the default one with the TLS settings
+// and address of the configuration applied, overridden by the environment
+// variables of Vault.
+func (r *RetrieVault) vaultClientConfig() (*api.Config, error) {
+	if r.vaultConfig != nil {
+		return r.vaultConfig, nil
+	}
 	config := api.DefaultConfig()
-	if retrievault.CACertPath != "" || retrievault.Insecure {
+	if (r.ClientCertPath == "") != (r.ClientKeyPath == "") {
+		err := fmt.Errorf("Both client_cert_path and client_key_path must be set")
+		log.Msg.WithField("msg", err.Error()).Error("Error when applying TLS configuration")
+		return nil, err
+	}
+	if r.CACertPath != "" || r.Insecure || r.ClientCertPath != "" {
 		tlsconfig := &api.TLSConfig{
-			CACert:   retrievault.CACertPath,
-			Insecure: retrievault.Insecure,
+			CACert:     r.CACertPath,
+			ClientCert: r.ClientCertPath,
+			ClientKey:  r.ClientKeyPath,
+			Insecure:   r.Insecure,
 		}
 		if err := config.ConfigureTLS(tlsconfig); err != nil {
 			log.Msg.WithFields(logrus.Fields{
@@ -125,80 +291,62 @@ func SetupApp(configPath, logPath, loglevel string) (*RetrieVault, error) {
 			return nil, err
 		}
 	}
-	if retrievault.VaultAddr != "" { // this allows to use localhost if not set
-		config.Address = retrievault.VaultAddr
+	if r.VaultAddr != "" { // this allows to use localhost if not set
+		config.Address = r.VaultAddr
 	}
 	if err := config.ReadEnvironment(); err != nil {
 		log.Msg.WithField("msg", err.Error()).Warn("Error when loading configuration from environment")
 	}
-	client, err := api.NewClient(config)
-	if err != nil {
-		log.Msg.WithFields(logrus.Fields{
-			"msg":    err.Error(),
-			"config": config,
-		}).Error("Error when creating Vault client from configuration")
-		return nil, err
-	}
-	if env.GetOrElse("VAULT_TOKEN", "") == "" && retrievault.VaultToken != "" {
-		client.SetToken(retrievault.VaultToken)
-	}
-	retrievault.client = client.Logical()
-	return retrievault, nil
+	return config, nil
 }
 
+// FetchSecrets fetches every secret, and returns the first error
+// encountered, cancelling the secrets still being fetched.
 func (r *RetrieVault) FetchSecrets(ctx context.Context) error {
-	cancelCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	e := make(chan error)
-	wait := 0
-	for _, secret := range r.Secrets {
-		select {
-		// If we cancel the parent context, we must return inmediately
-		case <-ctx.Done():
-			log.Msg.WithField("msg", ctx.Err().Error()).Error("Context cancelled")
-			return ctx.Err()
-		default:
-		}
-		var err error
-		var retr Retriever
-		switch secret.Type {
-		case certs:
-			retr = NewCerts()
-			err = json.Unmarshal(secret.Parameters, retr)
-		case generic:
-			retr = NewGeneric()
-			if len(secret.Parameters) != 0 {
-				err = json.Unmarshal(secret.Parameters, retr)
-			}
-		default:
-			log.Msg.WithField("secret_type", secret.Type).Error("Invalid type.")
-			return fmt.Errorf("Invalid secret type %s", secret.Type)
-		}
+	_, _, err := r.fetch(ctx, ctx, true)
+	return err
+}
 
+// fetchSecret fetches a single secret with the given retriever.
+func (r *RetrieVault) fetchSecret(ctx context.Context, secret *Secret, retr Retriever, e chan error) {
+	er := make(chan error, 1)
+	go r.identityOf(secret).use(func(client *api.Client) {
+		if setter, ok := retr.(ClientSetter); ok {
+			setter.SetClient(client)
+		}
+		retr.FetchSecret(ctx, secret.VaultPath, secret.Path, client.Logical(), er)
+	})
+	select {
+	case <-ctx.Done():
+		e <- ctx.Err()
+		return
+	case err := <-er:
 		if err != nil {
-			log.Msg.WithFields(logrus.Fields{
-				"msg":         err.Error(),
-				"secret_type": secret.Type,
-			}).Error("Unable to unmarshall parameters for this secret Type")
-			return err
+			e <- err
+			return
 		}
-		go retr.FetchSecret(cancelCtx, secret.VaultPath, secret.Path, r.client, e)
-		wait++
 	}
+	if provider, ok := retr.(EnvProvider); ok {
+		r.setEnv(secret, provider.Env())
+	}
+	e <- nil
+	return
+}
 
-	for i := 0; i < wait; i++ {
-		select {
-		case <-ctx.Done():
-			log.Msg.WithField("msg", ctx.Err().Error()).Error("Context cancelled")
-			return ctx.Err()
-		case err := <-e:
-			if err != nil {
-				log.Msg.WithFields(logrus.Fields{
-					"msg": err.Error(),
-				}).Error("Error when fetching secret")
-				return err
-			}
-		}
+// runHook runs the OnChange hook of a secret fetched with the given retriever
+// if any of its files was modified. It is run once the fetch is done, so that
+// it isn't bounded by the fetch timeout, but it is stopped when ctx is
+// cancelled.
+func (r *RetrieVault) runHook(ctx context.Context, secret *Secret, retr Retriever) {
+	reporter, ok := retr.(ChangeReporter)
+	if !ok || !reporter.Changed() || secret.OnChange == nil || r.inMemory {
+		return
+	}
+	log.Msg.WithField("vault_path", secret.VaultPath).Info("Secret changed. Running hook...")
+	if err := secret.OnChange.run(ctx); err != nil {
+		log.Msg.WithFields(logrus.Fields{
+			"msg":        err.Error(),
+			"vault_path": secret.VaultPath,
+		}).Error("Error when running hook")
 	}
-	return nil
 }
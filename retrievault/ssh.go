@@ -0,0 +1,359 @@
+package retrievault
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sshCAMode      = "ca"
+	sshOTPMode     = "otp"
+	sshDefaultBits = 2048
+	sshDefaultPerm = "0600"
+	sshCertType    = "user"
+)
+
+// SSH fetches credentials from the SSH backend, in one of two modes:
+//
+//   - "ca": the public key of a local keypair, which is generated if it
+//     doesn't exist yet, is signed at "<mount>/sign/<role>", and the
+//     resulting certificate is written next to it.
+//   - "otp": a one-time password is issued at "<mount>/creds/<role>" for the
+//     given IP and username.
+type SSH struct {
+
+	// Mode is either "ca" or "otp". Defaults to "ca".
+	Mode string `json:"mode,omitempty"`
+
+	// ValidPrincipals are the principals requested for the certificate
+	ValidPrincipals []string `json:"valid_principals,omitempty"`
+
+	// TTL is the requested Time To Live of the certificate
+	TTL string `json:"ttl,omitempty"`
+
+	// CertType is the type of certificate requested: "user" or "host".
+	// Defaults to "user".
+	CertType string `json:"cert_type,omitempty"`
+
+	// KeyBits is the size of the RSA key generated if there is no keypair
+	KeyBits int `json:"key_bits,omitempty"`
+
+	// PrivateKey is the destination of the private key of the keypair
+	PrivateKey fileParameters `json:"private_key,omitempty"`
+
+	// PublicKey is the destination of the public key of the keypair
+	PublicKey fileParameters `json:"public_key,omitempty"`
+
+	// Certificate is the destination of the signed certificate
+	Certificate fileParameters `json:"certificate,omitempty"`
+
+	// IP is the address of the host to log in to with the one-time password
+	IP string `json:"ip,omitempty"`
+
+	// Username is the user to log in as with the one-time password
+	Username string `json:"username,omitempty"`
+
+	// OTP is the destination of the one-time password
+	OTP fileParameters `json:"otp,omitempty"`
+
+	secret *api.Secret
+	writer
+}
+
+func NewSSH() *SSH {
+	return new(SSH)
+}
+
+// Lease returns the last one-time password issued or, in "ca" mode, a
+// secret whose lease lasts until the certificate expires, so that it is
+// signed again before that.
+func (s *SSH) Lease() *api.Secret {
+	return s.secret
+}
+
+// withDefaultPerm returns params with the given permissions if none are set.
+func withDefaultPerm(params fileParameters, perm string) fileParameters {
+	if params.Perm == "" {
+		params.Perm = perm
+	}
+	return params
+}
+
+// splitRolePath splits a Vault path like "ssh/sign/role" into the mount and
+// the role, around the given endpoint.
+func splitRolePath(vaultPath, endpoint string) (string, string, error) {
+	parts := strings.SplitN(strings.Trim(vaultPath, "/"), "/"+endpoint+"/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Vault path %s must be like <mount>/%s/<role>", vaultPath, endpoint)
+	}
+	return parts[0], parts[1], nil
+}
+
+// authorizedKey encodes a public key in the authorized_keys format.
+func authorizedKey(key crypto.PublicKey) ([]byte, error) {
+	public, err := ssh.NewPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.MarshalAuthorizedKey(public), nil
+}
+
+// certValidBefore returns the end of the validity period of an SSH
+// certificate in the authorized_keys format, or the zero time if it is valid
+// forever.
+func certValidBefore(cert string) (time.Time, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cert))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Malformed SSH certificate: %s", err)
+	}
+	certificate, ok := key.(*ssh.Certificate)
+	if !ok {
+		return time.Time{}, fmt.Errorf("Unexpected SSH key of type %s instead of a certificate", key.Type())
+	}
+	if certificate.ValidBefore == ssh.CertTimeInfinity {
+		return time.Time{}, nil
+	}
+	return time.Unix(int64(certificate.ValidBefore), 0), nil
+}
+
+// keypair returns the public key to sign, derived from the local private key
+// if there is one, or from a new keypair if it doesn't exist. The files
+// holding the keys are returned too, if they have to be written.
+func (s *SSH) keypair(privateFile string, privatePerm os.FileMode, publicFile string, publicPerm os.FileMode) ([]byte, []*fileContent, error) {
+	private, err := s.readPrivateKey(privateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if err == nil {
+		key, err := ssh.ParseRawPrivateKey(private)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to parse private key %s: %s", privateFile, err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, nil, fmt.Errorf("Unsupported private key %s", privateFile)
+		}
+		public, err := authorizedKey(signer.Public())
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Msg.WithField("file", privateFile).Debug("Reusing existing private key")
+		if current, err := ioutil.ReadFile(publicFile); err == nil && sameKey(current, public) {
+			return current, nil, nil
+		}
+		log.Msg.WithField("file", publicFile).Info("Public key missing or not matching the private key. Writing it again...")
+		return public, []*fileContent{&fileContent{publicFile, public, publicPerm}}, nil
+	}
+
+	bits := s.KeyBits
+	if bits == 0 {
+		bits = sshDefaultBits
+	}
+	log.Msg.WithField("bits", bits).Info("Generating SSH keypair")
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	private = pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	public, err := authorizedKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return public, []*fileContent{
+		&fileContent{privateFile, private, privatePerm},
+		&fileContent{publicFile, public, publicPerm},
+	}, nil
+}
+
+// readPrivateKey reads the local private key. In memory, there is never one,
+// so that a new keypair is generated.
+func (s *SSH) readPrivateKey(privateFile string) ([]byte, error) {
+	if s.inMemory() {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.ReadFile(privateFile)
+}
+
+// sameKey reports whether two public keys in the authorized_keys format are
+// the same, regardless of their comments.
+func sameKey(a, b []byte) bool {
+	keyA, _, _, _, err := ssh.ParseAuthorizedKey(a)
+	if err != nil {
+		return false
+	}
+	keyB, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(keyA.Marshal(), keyB.Marshal())
+}
+
+// sign signs the local public key, generating a keypair first if needed,
+// and returns the files to write.
+func (s *SSH) sign(client *api.Logical, vaultPath, dest string) ([]*fileContent, error) {
+	paths := make([]string, 3)
+	perms := make([]os.FileMode, 3)
+	for i, f := range []struct {
+		defaultFile string
+		params      fileParameters
+	}{
+		{"id_rsa", withDefaultPerm(s.PrivateKey, sshDefaultPerm)},
+		{"id_rsa.pub", s.PublicKey},
+		{"id_rsa-cert.pub", s.Certificate},
+	} {
+		var err error
+		if paths[i], perms[i], err = s.getDestAndPerms(f.defaultFile, f.params, dest); err != nil {
+			return nil, err
+		}
+	}
+	public, files, err := s.keypair(paths[0], perms[0], paths[1], perms[1])
+	if err != nil {
+		return nil, err
+	}
+
+	certType := s.CertType
+	if certType == "" {
+		certType = sshCertType
+	}
+	data := map[string]interface{}{
+		"public_key": string(public),
+		"cert_type":  certType,
+	}
+	if len(s.ValidPrincipals) != 0 {
+		data["valid_principals"] = strings.Join(s.ValidPrincipals, ",")
+	}
+	if s.TTL != "" {
+		data["ttl"] = s.TTL
+	}
+	secret, err := client.Write(vaultPath, data)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("No certificate signed at path %s", vaultPath)
+	}
+	cert, _ := secret.Data["signed_key"].(string)
+	if cert == "" {
+		return nil, fmt.Errorf("No signed key returned at path %s", vaultPath)
+	}
+	validBefore, err := certValidBefore(cert)
+	if err != nil {
+		return nil, err
+	}
+	log.Msg.WithFields(logrus.Fields{
+		"vault_path":   vaultPath,
+		"serial":       secret.Data["serial_number"],
+		"valid_before": validBefore.Format(time.RFC3339),
+	}).Info("SSH certificate signed")
+	s.secret = nil
+	if !validBefore.IsZero() {
+		s.secret = &api.Secret{LeaseDuration: int(time.Until(validBefore).Seconds())}
+	}
+
+	if !strings.HasSuffix(cert, "\n") {
+		cert += "\n"
+	}
+	return append(files, &fileContent{paths[2], []byte(cert), perms[2]}), nil
+}
+
+// otp issues a one-time password and returns the file to write.
+func (s *SSH) otp(client *api.Logical, vaultPath, dest string) ([]*fileContent, error) {
+	mount, role, err := splitRolePath(vaultPath, "creds")
+	if err != nil {
+		return nil, err
+	}
+	if s.IP == "" {
+		return nil, fmt.Errorf("An IP must be set in order to issue a one-time password")
+	}
+	file, perm, err := s.getDestAndPerms("otp", withDefaultPerm(s.OTP, sshDefaultPerm), dest)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{"ip": s.IP}
+	if s.Username != "" {
+		data["username"] = s.Username
+	}
+	secret, err := client.Write(fmt.Sprintf("%s/creds/%s", mount, role), data)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("No one-time password issued at path %s", vaultPath)
+	}
+	if keyType, _ := secret.Data["key_type"].(string); keyType != sshOTPMode {
+		return nil, fmt.Errorf("Role %s issues credentials of type %s instead of one-time passwords", role, keyType)
+	}
+	key, _ := secret.Data["key"].(string)
+	if key == "" {
+		return nil, fmt.Errorf("No one-time password returned at path %s", vaultPath)
+	}
+	log.Msg.WithFields(logrus.Fields{
+		"vault_path": vaultPath,
+		"ip":         s.IP,
+		"username":   secret.Data["username"],
+	}).Info("SSH one-time password issued")
+	s.secret = secret
+	return []*fileContent{&fileContent{file, []byte(key), perm}}, nil
+}
+
+func (s *SSH) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
+	log.Msg.WithFields(logrus.Fields{
+		"vault_path": vaultPath,
+		"mode":       s.Mode,
+	}).Debug("Fetching secret at path")
+	var (
+		files []*fileContent
+		err   error
+	)
+	switch s.Mode {
+	case "", sshCAMode:
+		files, err = s.sign(client, vaultPath, dest)
+	case sshOTPMode:
+		files, err = s.otp(client, vaultPath, dest)
+	default:
+		err = fmt.Errorf("Invalid SSH mode %s. Must be one of: %s, %s", s.Mode, sshCAMode, sshOTPMode)
+	}
+	if err != nil {
+		log.Msg.WithFields(logrus.Fields{
+			"msg":        err.Error(),
+			"vault_path": vaultPath,
+		}).Error("Error when fetching SSH credentials")
+		e <- err
+		return
+	}
+
+	er := make(chan error, 1)
+	go s.writeInFiles(files, er)
+	select {
+	case <-ctx.Done():
+		log.Msg.Error("Parent context cancelled")
+		e <- ctx.Err()
+		return
+	case err := <-er:
+		if err != nil {
+			log.Msg.Error("Error when writing secret to file")
+			e <- err
+			return
+		}
+	}
+	e <- nil
+	return
+}
@@ -0,0 +1,207 @@
+package retrievault
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHCert builds an SSH certificate valid until validBefore, signed by a
+// throwaway CA.
+func testSSHCert(t *testing.T, validBefore uint64) string {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:         ca.PublicKey(),
+		Serial:      1,
+		CertType:    ssh.UserCert,
+		KeyId:       "key-id",
+		ValidBefore: validBefore,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert)))
+}
+
+func TestCertValidBefore(t *testing.T) {
+	validBefore, err := certValidBefore(testSSHCert(t, 1500000000))
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if validBefore.Unix() != 1500000000 {
+		t.Error("Expected", 1500000000, "got", validBefore.Unix())
+	}
+	if validBefore, _ := certValidBefore(testSSHCert(t, ssh.CertTimeInfinity)); !validBefore.IsZero() {
+		t.Error("Expected a certificate valid forever, got", validBefore)
+	}
+	if _, err := certValidBefore("ssh-rsa AAAA"); err == nil {
+		t.Error("Expected non nil error for a malformed certificate, got nil error")
+	}
+}
+
+func TestSSHSign(t *testing.T) {
+	validBefore := time.Now().Add(time.Hour)
+	client, requests, stop := testVault(t, map[string]interface{}{
+		"/v1/ssh/sign/ops": map[string]interface{}{
+			"data": map[string]interface{}{"signed_key": testSSHCert(t, uint64(validBefore.Unix()))},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &SSH{KeyBits: 1024, ValidPrincipals: []string{"ops", "root"}}
+	e := make(chan error, 1)
+	s.FetchSecret(context.Background(), "ssh/sign/ops", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	public, _ := ioutil.ReadFile(path.Join(dir, "id_rsa.pub"))
+	if !strings.HasPrefix(string(public), "ssh-rsa ") {
+		t.Error("Expected an RSA public key, got", string(public))
+	}
+	if body := (*requests)[0].body; body["public_key"] != string(public) || body["valid_principals"] != "ops,root" {
+		t.Error("Expected the public key to be signed for ops,root, got", body)
+	}
+	if fi, err := os.Stat(path.Join(dir, "id_rsa")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Error("Expected a private key with permissions 0600, got", fi, err)
+	}
+	if _, err := os.Stat(path.Join(dir, "id_rsa-cert.pub")); err != nil {
+		t.Error("Expected a signed certificate, got", err)
+	}
+	if lease := s.Lease(); lease == nil || lease.LeaseDuration <= 3500 || lease.LeaseDuration > 3600 {
+		t.Error("Expected a lease lasting until the certificate expires, got", lease)
+	}
+
+	// The keypair is reused when signing again
+	s.FetchSecret(context.Background(), "ssh/sign/ops", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if body := (*requests)[1].body; body["public_key"] != string(public) {
+		t.Error("Expected the same public key to be signed again, got", body["public_key"])
+	}
+}
+
+func TestSSHKeypair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateFile, publicFile := path.Join(dir, "id_rsa"), path.Join(dir, "id_rsa.pub")
+	ioutil.WriteFile(privateFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600)
+	expected, _ := authorizedKey(&key.PublicKey)
+
+	// The public key is derived from the private key, whether it is missing
+	// or it doesn't match the private key
+	other, _ := rsa.GenerateKey(rand.Reader, 1024)
+	otherPublic, _ := authorizedKey(&other.PublicKey)
+	for _, current := range [][]byte{nil, otherPublic} {
+		os.Remove(publicFile)
+		if current != nil {
+			ioutil.WriteFile(publicFile, current, 0644)
+		}
+		s := &SSH{}
+		public, files, err := s.keypair(privateFile, 0600, publicFile, 0644)
+		if err != nil {
+			t.Fatal("Expected nil error, got", err)
+		}
+		if string(public) != string(expected) {
+			t.Error("For", string(current), "expected", string(expected), "got", string(public))
+		}
+		if len(files) != 1 || files[0].path != publicFile {
+			t.Error("For", string(current), "expected the public key to be written, got", files)
+		}
+	}
+
+	// A matching public key is kept as it is
+	ioutil.WriteFile(publicFile, append(expected[:len(expected)-1], []byte(" ops@host\n")...), 0644)
+	s := &SSH{}
+	if _, files, err := s.keypair(privateFile, 0600, publicFile, 0644); err != nil || len(files) != 0 {
+		t.Error("Expected the public key to be kept, got", files, err)
+	}
+
+	// In memory, the local keypair is never reused
+	s = &SSH{KeyBits: 1024}
+	s.keepInMemory()
+	if public, files, err := s.keypair(privateFile, 0600, publicFile, 0644); err != nil || len(files) != 2 || sameKey(public, expected) {
+		t.Error("Expected a new keypair in memory, got", files, err)
+	}
+
+	// A private key which can't be read is never replaced
+	for _, content := range []string{"", "garbage"} {
+		os.Remove(privateFile)
+		if content == "" {
+			os.Mkdir(privateFile, 0700)
+		} else {
+			ioutil.WriteFile(privateFile, []byte(content), 0600)
+		}
+		s = &SSH{KeyBits: 1024}
+		if _, files, err := s.keypair(privateFile, 0600, publicFile, 0644); err == nil || len(files) != 0 {
+			t.Error("For", content, "expected an error and no files, got", files, err)
+		}
+	}
+
+	// A public key without its private key is replaced by a new keypair
+	os.Remove(privateFile)
+	s = &SSH{KeyBits: 1024}
+	if _, files, err := s.keypair(privateFile, 0600, publicFile, 0644); err != nil || len(files) != 2 {
+		t.Error("Expected a new keypair, got", files, err)
+	}
+}
+
+func TestSSHOTP(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/ssh/creds/otp_key_role": map[string]interface{}{
+			"lease_id":       "ssh/creds/otp_key_role/1234",
+			"lease_duration": 600,
+			"data":           map[string]interface{}{"key": "otp", "key_type": "otp", "username": "ubuntu"},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &SSH{Mode: sshOTPMode, IP: "10.0.0.1", Username: "ubuntu"}
+	e := make(chan error, 1)
+	s.FetchSecret(context.Background(), "ssh/creds/otp_key_role", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	content, _ := ioutil.ReadFile(path.Join(dir, "otp"))
+	if string(content) != "otp" {
+		t.Error("Expected", "otp", "got", string(content))
+	}
+}
@@ -0,0 +1,180 @@
+package retrievault
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// Template renders several secrets into a single file, by means of a Go
+// text/template. Secrets are read with the "secret" function, e.g.:
+//
+//	password={{ secret "generic/db" "password" }}
+type Template struct {
+
+	// Template is the inline template to render
+	Template string `json:"template,omitempty"`
+
+	// TemplateFile is the path to a file holding the template to render. It
+	// is only used if Template is not set.
+	TemplateFile string `json:"template_file,omitempty"`
+
+	fileParameters
+	secret *api.Secret
+	writer
+}
+
+func NewTemplate() *Template {
+	return new(Template)
+}
+
+// Lease returns a secret holding the shortest lease of all the secrets read
+// by the template, so that it is rendered again before any of them expires.
+// The lease is not renewable, as the rest of the secrets must be read again.
+func (t *Template) Lease() *api.Secret {
+	return t.secret
+}
+
+// defaultFile returns the name of the rendered file if no path is set, which
+// is the name of the template file without its extension.
+func (t *Template) defaultFile() (string, error) {
+	if t.TemplateFile == "" || t.Template != "" {
+		return "", fmt.Errorf("A path must be set in order to render an inline template")
+	}
+	name := path.Base(t.TemplateFile)
+	return strings.TrimSuffix(name, path.Ext(name)), nil
+}
+
+func (t *Template) text() (string, error) {
+	if t.Template != "" {
+		return t.Template, nil
+	}
+	if t.TemplateFile == "" {
+		return "", fmt.Errorf("Either template or template_file must be set")
+	}
+	content, err := ioutil.ReadFile(t.TemplateFile)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// render renders the template, reading the secrets it needs with client.
+func (t *Template) render(client *api.Logical) ([]byte, error) {
+	text, err := t.text()
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]*api.Secret)
+	funcs := template.FuncMap{
+		"secret": func(vaultPath, key string) (interface{}, error) {
+			secret, ok := secrets[vaultPath]
+			if !ok {
+				var err error
+				log.Msg.WithField("vault_path", vaultPath).Debug("Fetching secret at path")
+				secret, err = client.Read(vaultPath)
+				if err != nil {
+					return nil, err
+				}
+				if secret == nil {
+					return nil, fmt.Errorf("No secret found at path %s", vaultPath)
+				}
+				secrets[vaultPath] = secret
+			}
+			value, ok := secret.Data[key]
+			if !ok {
+				return nil, fmt.Errorf("No key %s found in secret %s", key, vaultPath)
+			}
+			return value, nil
+		},
+		"base64Decode": func(s string) (string, error) {
+			decoded, err := base64.StdEncoding.DecodeString(s)
+			return string(decoded), err
+		},
+		"base64Encode": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"toJSON": func(v interface{}) (string, error) {
+			encoded, err := json.Marshal(v)
+			return string(encoded), err
+		},
+		"indent": func(spaces int, s string) string {
+			padding := strings.Repeat(" ", spaces)
+			return padding + strings.Replace(s, "\n", "\n"+padding, -1)
+		},
+	}
+	tmpl, err := template.New("template").Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return nil, err
+	}
+
+	t.secret = nil
+	for _, secret := range secrets {
+		if secret.LeaseDuration > 0 && (t.secret == nil || secret.LeaseDuration < t.secret.LeaseDuration) {
+			t.secret = &api.Secret{LeaseDuration: secret.LeaseDuration}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// FetchSecret renders the template and writes the result in a single file.
+// vaultPath is not used, as the template reads every secret it needs.
+func (t *Template) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
+	defaultFile := ""
+	if t.Path == "" {
+		var err error
+		if defaultFile, err = t.defaultFile(); err != nil {
+			e <- err
+			return
+		}
+	}
+	file, perm, err := t.getDestAndPerms(defaultFile, t.fileParameters, dest)
+	if err != nil {
+		log.Msg.WithFields(logrus.Fields{
+			"template_file": t.TemplateFile,
+			"permissions":   perm,
+		}).Error(err.Error())
+		e <- err
+		return
+	}
+	data, err := t.render(client)
+	if err != nil {
+		log.Msg.WithFields(logrus.Fields{
+			"msg":           err.Error(),
+			"template_file": t.TemplateFile,
+		}).Error("Error when rendering template")
+		e <- err
+		return
+	}
+
+	er := make(chan error, 1)
+	go t.writeInFile(file, data, perm, er)
+	select {
+	case <-ctx.Done():
+		log.Msg.Error("Parent context cancelled")
+		e <- ctx.Err()
+		return
+	case err := <-er:
+		if err != nil {
+			log.Msg.Error("Error when writing secret to file")
+			e <- err
+			return
+		}
+	}
+	e <- nil
+	return
+}
@@ -0,0 +1,82 @@
+package retrievault
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type testtemplate struct {
+	template string
+	expected string
+	e        bool
+}
+
+var testtemplates = []*testtemplate{
+	&testtemplate{`user={{ secret "generic/db" "user" }}`, "user=admin", false},
+	&testtemplate{`{{ secret "generic/db" "cert" | base64Decode }}`, "cert", false},
+	&testtemplate{`{{ secret "generic/db" "user" | toJSON }}`, `"admin"`, false},
+	&testtemplate{"db:\n{{ indent 2 \"a\\nb\" }}", "db:\n  a\n  b", false},
+	&testtemplate{`{{ secret "generic/db" "missing" }}`, "", true},
+	&testtemplate{`{{ secret "generic/missing" "user" }}`, "", true},
+}
+
+func TestTemplateRender(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/generic/db": map[string]interface{}{
+			"lease_duration": 3600,
+			"data":           map[string]interface{}{"user": "admin", "cert": "Y2VydA=="},
+		},
+	})
+	defer stop()
+	for _, pair := range testtemplates {
+		tmpl := &Template{Template: pair.template}
+		rendered, err := tmpl.render(client.Logical())
+		if pair.e {
+			if err == nil {
+				t.Error("For", pair.template,
+					"expected non nil error",
+					"got nil error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error("For", pair.template, "expected nil error", "got", err)
+		} else if string(rendered) != pair.expected {
+			t.Error("For", pair.template, "expected", pair.expected, "got", string(rendered))
+		}
+	}
+}
+
+func TestTemplateFetchSecret(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/generic/db": map[string]interface{}{
+			"lease_duration": 3600,
+			"data":           map[string]interface{}{"user": "admin"},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	templateFile := path.Join(dir, "app.properties.tmpl")
+	ioutil.WriteFile(templateFile, []byte(`user={{ secret "generic/db" "user" }}`), 0644)
+
+	tmpl := &Template{TemplateFile: templateFile}
+	e := make(chan error, 1)
+	tmpl.FetchSecret(context.Background(), "", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	content, _ := ioutil.ReadFile(path.Join(dir, "app.properties"))
+	if string(content) != "user=admin" {
+		t.Error("Expected", "user=admin", "got", string(content))
+	}
+	if lease := tmpl.Lease(); lease == nil || lease.LeaseDuration != 3600 {
+		t.Error("Expected a lease of 3600 seconds, got", lease)
+	}
+}
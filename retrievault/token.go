@@ -0,0 +1,192 @@
+package retrievault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// errTokenMaxTTL is returned when a token is renewed for less than its
+// previous TTL, as it is close to its maximum TTL.
+var errTokenMaxTTL = errors.New("The token is reaching its maximum TTL")
+
+// tokenManager keeps the token of a Vault client alive. The token is renewed
+// ahead of its expiry and, if it can't be renewed anymore, a new one is
+// obtained through the configured authentication method, if any.
+type tokenManager struct {
+	client        *api.Client
+	auth          *Auth
+	authenticator Authenticator
+	ttl           time.Duration
+	renewable     bool
+
+	// mu serializes the token swaps against the requests made with the
+	// client, as the client reads its token without any synchronization
+	mu sync.RWMutex
+}
+
+func newTokenManager(client *api.Client, auth *Auth) (*tokenManager, error) {
+	m := &tokenManager{client: client, auth: auth}
+	if auth != nil {
+		a, err := newAuthenticator(auth)
+		if err != nil {
+			return nil, err
+		}
+		m.authenticator = a
+	}
+	return m, nil
+}
+
+func (m *tokenManager) log() *logrus.Entry {
+	if m.auth == nil {
+		return log.Msg.WithField("auth_method", "token")
+	}
+	return log.Msg.WithField("auth_method", m.auth.Method)
+}
+
+// setToken sets the token of the client, once no request is being made
+// with it.
+func (m *tokenManager) setToken(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.client.SetToken(token)
+}
+
+// login obtains a new token through the authentication method, and sets it
+// in the client.
+func (m *tokenManager) login() error {
+	if m.auth == nil {
+		return fmt.Errorf("No authentication method configured to obtain a new token")
+	}
+	auth, err := login(m.client, m.auth, m.authenticator)
+	if err != nil {
+		return err
+	}
+	m.setToken(auth.ClientToken)
+	m.ttl = time.Duration(auth.LeaseDuration) * time.Second
+	m.renewable = auth.Renewable
+	return nil
+}
+
+// lookup looks up the current token, logging its TTL and policies. The
+// values already known are kept if the lookup fails.
+func (m *tokenManager) lookup() {
+	secret, err := m.client.Auth().Token().LookupSelf()
+	if err != nil || secret == nil {
+		msg := "empty response"
+		if err != nil {
+			msg = err.Error()
+		}
+		m.log().WithField("msg", msg).Warn("Unable to look up the Vault token")
+		return
+	}
+	ttl, _ := intValue(secret.Data["ttl"])
+	m.ttl = time.Duration(ttl) * time.Second
+	m.renewable, _ = secret.Data["renewable"].(bool)
+	var policies []string
+	if values, ok := secret.Data["policies"].([]interface{}); ok {
+		for _, policy := range values {
+			policies = append(policies, fmt.Sprintf("%v", policy))
+		}
+	}
+	m.log().WithFields(logrus.Fields{
+		"ttl":       m.ttl.String(),
+		"renewable": m.renewable,
+		"policies":  policies,
+	}).Info("Vault token looked up")
+}
+
+// renew renews the token. An error is returned if the token can't be
+// renewed for, at least, its current TTL, as that means that it is close to
+// its maximum TTL.
+func (m *tokenManager) renew() error {
+	secret, err := m.client.Auth().Token().RenewSelf(0)
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.Auth == nil {
+		return fmt.Errorf("Empty response when renewing the token")
+	}
+	ttl := time.Duration(secret.Auth.LeaseDuration) * time.Second
+	if ttl < m.ttl {
+		m.ttl = ttl
+		return errTokenMaxTTL
+	}
+	m.ttl = ttl
+	m.renewable = secret.Auth.Renewable
+	m.log().WithField("ttl", m.ttl.String()).Debug("Vault token renewed")
+	return nil
+}
+
+// run keeps the token alive until ctx is cancelled. Tokens are renewed once
+// fraction of their TTL has passed.
+func (m *tokenManager) run(ctx context.Context, fraction float64) {
+	for {
+		if m.ttl == 0 {
+			m.log().Debug("The Vault token never expires. Nothing to renew")
+			return
+		}
+		wait := time.Duration(float64(m.ttl) * fraction)
+		m.log().WithField("wait", wait.String()).Debug("Scheduling token renewal")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		var err error
+		if m.renewable {
+			if err = m.renew(); err == nil {
+				continue
+			}
+		} else {
+			err = fmt.Errorf("The token is not renewable")
+		}
+		if m.auth == nil {
+			m.log().WithFields(logrus.Fields{
+				"msg": err.Error(),
+				"ttl": m.ttl.String(),
+			}).Warn("Unable to renew the Vault token, and no authentication method configured to obtain a new one")
+			if err == errTokenMaxTTL {
+				// Keep renewing until the maximum TTL is reached
+				continue
+			}
+			return
+		}
+		m.log().WithField("msg", err.Error()).Info("Unable to renew the Vault token. Logging in again")
+		for {
+			if err := m.login(); err == nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryInterval):
+			}
+		}
+	}
+}
+
+// intValue converts a numeric value decoded from a Vault response to int.
+func intValue(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case json.Number:
+		i, err := v.Int64()
+		return int(i), err
+	case float64:
+		return int(v), nil
+	case int:
+		return v, nil
+	case int64:
+		return int(v), nil
+	default:
+		return 0, fmt.Errorf("Invalid numeric value %v", value)
+	}
+}
@@ -0,0 +1,122 @@
+package retrievault
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTokenManagerLookup(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{
+		"/v1/auth/token/lookup-self": map[string]interface{}{
+			"data": map[string]interface{}{
+				"ttl":       3600,
+				"renewable": true,
+				"policies":  []string{"default"},
+			},
+		},
+	})
+	defer stop()
+	m, _ := newTokenManager(client, nil)
+	m.lookup()
+	if m.ttl != time.Hour {
+		t.Error("Expected", time.Hour, "got", m.ttl)
+	}
+	if !m.renewable {
+		t.Error("Expected renewable token")
+	}
+}
+
+type testrenewal struct {
+	ttl      int
+	expected error
+}
+
+var testrenewals = []*testrenewal{
+	&testrenewal{3600, nil},
+	&testrenewal{60, errTokenMaxTTL},
+}
+
+func TestTokenManagerRenew(t *testing.T) {
+	for _, pair := range testrenewals {
+		client, _, stop := testVault(t, map[string]interface{}{
+			"/v1/auth/token/renew-self": map[string]interface{}{
+				"auth": map[string]interface{}{
+					"client_token":   "token",
+					"lease_duration": pair.ttl,
+					"renewable":      true,
+				},
+			},
+		})
+		m, _ := newTokenManager(client, nil)
+		m.ttl = time.Hour
+		if err := m.renew(); err != pair.expected {
+			t.Error("For", pair.ttl, "expected", pair.expected, "got", err)
+		}
+		if m.ttl != time.Duration(pair.ttl)*time.Second {
+			t.Error("For", pair.ttl, "expected", time.Duration(pair.ttl)*time.Second, "got", m.ttl)
+		}
+		stop()
+	}
+}
+
+func TestTokenManagerLoginWhileFetching(t *testing.T) {
+	config, requests, stop := testVaultConfig(map[string]interface{}{
+		"/v1/auth/approle/login": map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   "token",
+				"lease_duration": 1,
+				"renewable":      false,
+			},
+		},
+		"/v1/secret/app": map[string]interface{}{
+			"data": map[string]interface{}{"password": "s3cr3t"},
+		},
+	})
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Unsetenv("VAULT_TOKEN")
+
+	secret := &Secret{Type: generic, Path: path.Join(dir, "app"), VaultPath: "secret/app"}
+	r, err := New(Config{
+		Auth:    &Auth{Method: "approle", Parameters: json.RawMessage(`{"role_id":"role","secret_id":"secret"}`)},
+		Secrets: []*Secret{secret},
+	}, WithVaultConfig(config))
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+
+	// The token is swapped every 10ms while the secret is being fetched
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		r.identity.tokens.run(ctx, 0.01)
+		close(done)
+	}()
+	w := &watcher{secret: secret, timeout: time.Second, rvault: r}
+	for ctx.Err() == nil {
+		if err := w.fetch(ctx); err != nil && ctx.Err() == nil {
+			t.Fatal("Expected nil error, got", err)
+		}
+	}
+	<-done
+	stop()
+
+	logins := 0
+	for _, req := range *requests {
+		if req.path == "/v1/auth/approle/login" {
+			logins++
+		}
+	}
+	if logins < 2 {
+		t.Error("Expected the token manager to log in again, got", logins, "logins")
+	}
+}
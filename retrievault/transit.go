@@ -0,0 +1,218 @@
+package retrievault
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// Transit decrypts ciphertext produced by the transit backend, given inline
+// or in local files, with the key at "<mount>/decrypt/<key>". Each plaintext
+// is written in its own file.
+type Transit struct {
+
+	// Files maps the name of each file to write to the ciphertext it holds
+	Files map[string]transitParams `json:"files"`
+
+	// Context is the base64 encoded context used to derive the key, which is
+	// used for every ciphertext that doesn't set its own one.
+	Context string `json:"context,omitempty"`
+
+	writer
+}
+
+type transitParams struct {
+
+	// Ciphertext is the inline ciphertext to decrypt
+	Ciphertext string `json:"ciphertext,omitempty"`
+
+	// CiphertextFile is the path to a file holding the ciphertext to
+	// decrypt. It is only used if Ciphertext is not set.
+	CiphertextFile string `json:"ciphertext_file,omitempty"`
+
+	// Context is the base64 encoded context used to derive the key
+	Context string `json:"context,omitempty"`
+
+	fileParameters
+}
+
+func NewTransit() *Transit {
+	return new(Transit)
+}
+
+func (p *transitParams) ciphertext() (string, error) {
+	if p.Ciphertext != "" {
+		return p.Ciphertext, nil
+	}
+	if p.CiphertextFile == "" {
+		return "", fmt.Errorf("Either ciphertext or ciphertext_file must be set")
+	}
+	content, err := ioutil.ReadFile(p.CiphertextFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// transitBatch sends every input to the transit endpoint at vaultPath in a
+// single request, and returns the output field of each result, in the same
+// order as the inputs. A single input is sent on its own, for compatibility
+// with Vault versions that don't support batches.
+func transitBatch(client *api.Logical, vaultPath string, inputs []map[string]interface{}, output string) ([]string, error) {
+	if len(inputs) == 1 {
+		secret, err := client.Write(vaultPath, inputs[0])
+		if err != nil {
+			return nil, err
+		}
+		if secret == nil {
+			return nil, fmt.Errorf("No result returned at path %s", vaultPath)
+		}
+		value, _ := secret.Data[output].(string)
+		if value == "" {
+			return nil, fmt.Errorf("No %s returned at path %s", output, vaultPath)
+		}
+		return []string{value}, nil
+	}
+
+	batch := make([]interface{}, len(inputs))
+	for i, input := range inputs {
+		batch[i] = input
+	}
+	secret, err := client.Write(vaultPath, map[string]interface{}{"batch_input": batch})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("No result returned at path %s", vaultPath)
+	}
+	results, _ := secret.Data["batch_results"].([]interface{})
+	if len(results) != len(inputs) {
+		return nil, fmt.Errorf("Expected %d results at path %s, got %d", len(inputs), vaultPath, len(results))
+	}
+	values := make([]string, len(results))
+	for i, r := range results {
+		result, _ := r.(map[string]interface{})
+		if msg, _ := result["error"].(string); msg != "" {
+			return nil, fmt.Errorf("Error in item %d at path %s: %s", i, vaultPath, msg)
+		}
+		value, _ := result[output].(string)
+		if value == "" {
+			return nil, fmt.Errorf("No %s returned for item %d at path %s", output, i, vaultPath)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// Encrypt encrypts each of the plaintexts with the transit key at vaultPath,
+// like "transit/encrypt/<key>", in a single request. The ciphertexts
+// returned can be decrypted by the "transit" secret type.
+func (r *RetrieVault) Encrypt(vaultPath string, plaintexts [][]byte, context string) ([]string, error) {
+	inputs := make([]map[string]interface{}, len(plaintexts))
+	for i, plaintext := range plaintexts {
+		inputs[i] = map[string]interface{}{
+			"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+		}
+		if context != "" {
+			inputs[i]["context"] = context
+		}
+	}
+	var (
+		ciphertexts []string
+		err         error
+	)
+	r.identity.use(func(client *api.Client) {
+		ciphertexts, err = transitBatch(client.Logical(), vaultPath, inputs, "ciphertext")
+	})
+	return ciphertexts, err
+}
+
+// FetchSecret decrypts every ciphertext in a single request, and writes each
+// plaintext in its own file.
+func (t *Transit) FetchSecret(ctx context.Context, vaultPath, dest string, client *api.Logical, e chan error) {
+	if len(t.Files) == 0 {
+		e <- fmt.Errorf("No files to decrypt with %s", vaultPath)
+		return
+	}
+	var (
+		names  []string
+		inputs []map[string]interface{}
+	)
+	for name, params := range t.Files {
+		ciphertext, err := params.ciphertext()
+		if err != nil {
+			log.Msg.WithFields(logrus.Fields{
+				"msg":    err.Error(),
+				"secret": name,
+			}).Error("Error when reading ciphertext")
+			e <- err
+			return
+		}
+		input := map[string]interface{}{"ciphertext": ciphertext}
+		if c := params.Context; c != "" {
+			input["context"] = c
+		} else if t.Context != "" {
+			input["context"] = t.Context
+		}
+		names = append(names, name)
+		inputs = append(inputs, input)
+	}
+
+	log.Msg.WithFields(logrus.Fields{
+		"vault_path":  vaultPath,
+		"ciphertexts": len(inputs),
+	}).Debug("Decrypting ciphertexts")
+	plaintexts, err := transitBatch(client, vaultPath, inputs, "plaintext")
+	if err != nil {
+		e <- err
+		return
+	}
+
+	er := make(chan error, len(names))
+	for i, name := range names {
+		plaintext, err := base64.StdEncoding.DecodeString(plaintexts[i])
+		if err != nil {
+			log.Msg.WithField("secret", name).Error("Error when decoding plaintext")
+			e <- err
+			return
+		}
+		var (
+			perm os.FileMode
+			file string
+		)
+		file, perm, err = t.getDestAndPerms(name, t.Files[name].fileParameters, dest)
+		if err != nil {
+			log.Msg.WithFields(logrus.Fields{
+				"secret":      name,
+				"permissions": perm,
+			}).Error(err.Error())
+			e <- err
+			return
+		}
+		go t.writeInFile(file, plaintext, perm, er)
+	}
+
+	for i := 0; i < len(names); i++ {
+		select {
+		case <-ctx.Done():
+			log.Msg.Error("Parent context cancelled")
+			e <- ctx.Err()
+			return
+		case err := <-er:
+			if err != nil {
+				log.Msg.Error("Error when writing secret to file")
+				e <- err
+				return
+			}
+		}
+	}
+	e <- nil
+	return
+}
@@ -0,0 +1,112 @@
+package retrievault
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTransitFetchSecret(t *testing.T) {
+	client, requests, stop := testVault(t, map[string]interface{}{
+		"/v1/transit/decrypt/app": map[string]interface{}{
+			"data": map[string]interface{}{
+				"batch_results": []interface{}{
+					map[string]interface{}{"plaintext": "aGVsbG8="},
+					map[string]interface{}{"plaintext": "aGVsbG8="},
+				},
+			},
+		},
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ciphertextFile := path.Join(dir, "db.enc")
+	ioutil.WriteFile(ciphertextFile, []byte("vault:v1:b\n"), 0644)
+
+	tr := &Transit{Files: map[string]transitParams{
+		"api":      transitParams{Ciphertext: "vault:v1:a"},
+		"password": transitParams{CiphertextFile: ciphertextFile, fileParameters: fileParameters{Perm: "0600"}},
+	}}
+	e := make(chan error, 1)
+	tr.FetchSecret(context.Background(), "transit/decrypt/app", dir, client.Logical(), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if len(*requests) != 1 {
+		t.Error("Expected a single batch request, got", len(*requests))
+	} else if batch, _ := (*requests)[0].body["batch_input"].([]interface{}); len(batch) != 2 {
+		t.Error("Expected a batch of 2 ciphertexts, got", (*requests)[0].body)
+	}
+	for _, file := range []string{"api", "password"} {
+		content, _ := ioutil.ReadFile(path.Join(dir, file))
+		if string(content) != "hello" {
+			t.Error("For", file, "expected", "hello", "got", string(content))
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	client, requests, stop := testVault(t, map[string]interface{}{
+		"/v1/transit/encrypt/app": map[string]interface{}{
+			"data": map[string]interface{}{"ciphertext": "vault:v1:a"},
+		},
+	})
+	defer stop()
+	r := &RetrieVault{identity: &identity{client: client, tokens: &tokenManager{client: client}}}
+	ciphertexts, err := r.Encrypt("transit/encrypt/app", [][]byte{[]byte("hello")}, "")
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if len(ciphertexts) != 1 || ciphertexts[0] != "vault:v1:a" {
+		t.Error("Expected", "vault:v1:a", "got", ciphertexts)
+	}
+	if body := (*requests)[0].body; body["plaintext"] != "aGVsbG8=" {
+		t.Error("Expected the plaintext to be base64 encoded, got", body["plaintext"])
+	}
+}
+
+func TestEncryptWhileLoggingIn(t *testing.T) {
+	config, _, stop := testVaultConfig(map[string]interface{}{
+		"/v1/auth/approle/login": map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   "token",
+				"lease_duration": 1,
+				"renewable":      false,
+			},
+		},
+		"/v1/transit/encrypt/app": map[string]interface{}{
+			"data": map[string]interface{}{"ciphertext": "vault:v1:a"},
+		},
+	})
+	defer stop()
+	os.Unsetenv("VAULT_TOKEN")
+	r, err := New(Config{
+		Auth: &Auth{Method: "approle", Parameters: json.RawMessage(`{"role_id":"role","secret_id":"secret"}`)},
+	}, WithVaultConfig(config))
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+
+	// The token is swapped every 10ms while encrypting, which the race
+	// detector reports unless both are serialized
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		r.identity.tokens.run(ctx, 0.01)
+		close(done)
+	}()
+	for ctx.Err() == nil {
+		if _, err := r.Encrypt("transit/encrypt/app", [][]byte{[]byte("hello")}, ""); err != nil {
+			t.Fatal("Expected nil error, got", err)
+		}
+	}
+	<-done
+}
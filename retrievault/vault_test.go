@@ -0,0 +1,70 @@
+package retrievault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// testRequest is a request received by a fake Vault server.
+type testRequest struct {
+	method string
+	path   string
+	query  string
+	token  string
+	body   map[string]interface{}
+}
+
+// testVault starts a fake Vault server which answers every request with the
+// response registered for its path, and records the requests received.
+// Responses are encoded as JSON, unless they are raw bytes.
+func testVault(t *testing.T, responses map[string]interface{}) (*api.Client, *[]*testRequest, func()) {
+	config, requests, stop := testVaultConfig(responses)
+	client, err := api.NewClient(config)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	client.ClearToken()
+	return client, requests, stop
+}
+
+// testVaultConfig starts a fake Vault server like testVault, and returns the
+// configuration of a client for it.
+func testVaultConfig(responses map[string]interface{}) (*api.Config, *[]*testRequest, func()) {
+	var (
+		requests []*testRequest
+		mu       sync.Mutex
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &testRequest{
+			method: r.Method,
+			path:   r.URL.Path,
+			query:  r.URL.RawQuery,
+			token:  r.Header.Get("X-Vault-Token"),
+		}
+		json.NewDecoder(r.Body).Decode(&req.body)
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		if raw, ok := response.([]byte); ok {
+			w.Write(raw)
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	return config, &requests, server.Close
+}
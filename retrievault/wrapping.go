@@ -0,0 +1,68 @@
+package retrievault
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/DatioBD/retrievault/utils/log"
+	"github.com/hashicorp/vault/api"
+)
+
+// unwrap returns the secret wrapped by the given response-wrapping token.
+// As those tokens can be used only once, failing to unwrap one means that
+// someone else may have intercepted it, so the error must not go unnoticed.
+func unwrap(client *api.Client, wrappingToken string) (*api.Secret, error) {
+	r := client.NewRequest("PUT", "/v1/sys/wrapping/unwrap")
+	r.ClientToken = wrappingToken
+	resp, err := client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		if resp != nil && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			log.Msg.WithField("msg", err.Error()).Error("The response-wrapping token has already been used or has expired. It may have been intercepted!")
+			return nil, fmt.Errorf("Response-wrapping token already used or expired: %s", err.Error())
+		}
+		return nil, fmt.Errorf("Unable to unwrap response-wrapping token: %s", err.Error())
+	}
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("Empty response when unwrapping response-wrapping token")
+	}
+	return secret, nil
+}
+
+// bootstrap unwraps the given response-wrapping token, which may hold either
+// a Vault token or an AppRole secret_id. It returns whether a token was set
+// in the client, so that there is no need to log in.
+func (m *tokenManager) bootstrap(wrappingToken string) (bool, error) {
+	secret, err := unwrap(m.client, wrappingToken)
+	if err != nil {
+		return false, err
+	}
+	if secret.Auth != nil && secret.Auth.ClientToken != "" {
+		log.Msg.WithField("policies", strings.Join(secret.Auth.Policies, ",")).Info("Vault token unwrapped")
+		m.setToken(secret.Auth.ClientToken)
+		return true, nil
+	}
+	if token, ok := secret.Data["token"].(string); ok && token != "" {
+		log.Msg.Info("Vault token unwrapped")
+		m.setToken(token)
+		return true, nil
+	}
+	if _, ok := secret.Data["secret_id"]; ok {
+		a, ok := m.authenticator.(*AppRole)
+		if !ok {
+			return false, fmt.Errorf("The response-wrapping token holds a secret_id, but the authentication method is not approle")
+		}
+		if err := a.setWrappedSecretID(secret); err != nil {
+			return false, err
+		}
+		log.Msg.Info("AppRole secret_id unwrapped")
+		return false, nil
+	}
+	return false, fmt.Errorf("The response-wrapping token holds neither a token nor a secret_id")
+}
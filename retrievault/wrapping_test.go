@@ -0,0 +1,58 @@
+package retrievault
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBootstrapToken(t *testing.T) {
+	client, requests, stop := testVault(t, map[string]interface{}{
+		"/v1/sys/wrapping/unwrap": map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": "token"},
+		},
+	})
+	defer stop()
+	m, _ := newTokenManager(client, nil)
+	unwrapped, err := m.bootstrap("wrapping-token")
+	if err != nil || !unwrapped {
+		t.Fatal("Expected unwrapped token, got", unwrapped, err)
+	}
+	if client.Token() != "token" {
+		t.Error("Expected", "token", "got", client.Token())
+	}
+	if (*requests)[0].token != "wrapping-token" {
+		t.Error("Expected", "wrapping-token", "got", (*requests)[0].token)
+	}
+}
+
+func TestBootstrapSecretID(t *testing.T) {
+	client, requests, stop := testVault(t, map[string]interface{}{
+		"/v1/sys/wrapping/unwrap": map[string]interface{}{
+			"data": map[string]interface{}{"secret_id": "secret"},
+		},
+		"/v1/auth/approle/login": map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": "token"},
+		},
+	})
+	defer stop()
+	m, _ := newTokenManager(client, &Auth{Method: "approle", Parameters: json.RawMessage(`{"role_id":"role"}`)})
+	unwrapped, err := m.bootstrap("wrapping-token")
+	if err != nil || unwrapped {
+		t.Fatal("Expected unwrapped secret_id, got", unwrapped, err)
+	}
+	if err := m.login(); err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if secretID := (*requests)[1].body["secret_id"]; secretID != "secret" {
+		t.Error("Expected", "secret", "got", secretID)
+	}
+}
+
+func TestBootstrapUsedToken(t *testing.T) {
+	client, _, stop := testVault(t, map[string]interface{}{})
+	defer stop()
+	m, _ := newTokenManager(client, nil)
+	if _, err := m.bootstrap("wrapping-token"); err == nil {
+		t.Error("Expected non nil error, got nil error")
+	}
+}
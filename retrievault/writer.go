@@ -1,16 +1,25 @@
 package retrievault
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"sync"
 
 	"github.com/DatioBD/retrievault/utils/log"
 	"github.com/DatioBD/retrievault/utils/os/permissions"
 )
 
-type writer struct{}
+type writer struct {
+	mu      sync.Mutex
+	changed bool
+
+	// files holds the content of the files written, by path, instead of
+	// writing them on disk when the writer keeps them in memory
+	files map[string][]byte
+}
 
 type fileParameters struct {
 	Path string `json:"path,omitempty"`
@@ -40,24 +49,214 @@ func (w *writer) getDestAndPerms(defaultFile string, params fileParameters, dest
 	return path.Clean(file), perm, nil
 }
 
-func (w *writer) writeInFile(filePath string, secret []byte, perm os.FileMode, e chan error) {
-	log.Msg.WithField("file", filePath).Debug("Writing secret in file")
+// fileContent holds the content to be written in a file.
+type fileContent struct {
+	path string
+	data []byte
+	perm os.FileMode
+}
+
+// stagedFile is a temporary file, fully written and synced to disk, which is
+// waiting to be renamed over its target.
+type stagedFile struct {
+	tmp    string
+	target string
+}
+
+// commit atomically replaces the target file with the staged one.
+func (s *stagedFile) commit() error {
+	if err := os.Rename(s.tmp, s.target); err != nil {
+		s.discard()
+		return err
+	}
+	syncDir(path.Dir(s.target))
+	return nil
+}
+
+// discard removes the staged file.
+func (s *stagedFile) discard() {
+	os.Remove(s.tmp)
+}
+
+// syncDir flushes a directory to disk, so that a rename inside it survives a
+// crash. This is best effort, as not every platform supports it.
+func syncDir(directory string) {
+	d, err := os.Open(directory)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// Changed reports whether any file has been modified since the writer was
+// created.
+func (w *writer) Changed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.changed
+}
+
+func (w *writer) setChanged() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.changed = true
+}
+
+// keepInMemory makes the writer keep the files written in memory, instead of
+// writing them on disk.
+func (w *writer) keepInMemory() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = make(map[string][]byte)
+}
+
+// inMemory reports whether the writer keeps the files written in memory.
+func (w *writer) inMemory() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.files != nil
+}
+
+// memoryFiles returns the files kept in memory, by path.
+func (w *writer) memoryFiles() map[string][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	files := make(map[string][]byte, len(w.files))
+	for file, data := range w.files {
+		files[file] = data
+	}
+	return files
+}
+
+// keep keeps the given files in memory, if the writer does so. It reports
+// whether they were kept.
+func (w *writer) keep(files []*fileContent) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.files == nil {
+		return false
+	}
+	for _, f := range files {
+		if current, ok := w.files[f.path]; !ok || !bytes.Equal(current, f.data) {
+			w.files[f.path] = append([]byte{}, f.data...)
+			w.changed = true
+		}
+	}
+	return true
+}
+
+// unchanged reports whether filePath already holds the given secret. If so,
+// its permissions are updated if needed, so that it doesn't need to be
+// written again.
+func (w *writer) unchanged(filePath string, secret []byte, perm os.FileMode) bool {
+	current, err := ioutil.ReadFile(filePath)
+	if err != nil || !bytes.Equal(current, secret) {
+		return false
+	}
+	if err := os.Chmod(filePath, perm); err != nil {
+		return false
+	}
+	log.Msg.WithField("file", filePath).Debug("Secret unchanged. Skipping...")
+	return true
+}
+
+// stage writes the secret into a temporary file in the same directory as
+// filePath, so that it can later be renamed over it.
+func (w *writer) stage(filePath string, secret []byte, perm os.FileMode) (*stagedFile, error) {
 	directory := path.Dir(filePath)
 	fi, err := os.Stat(directory)
 	if err != nil {
 		log.Msg.WithField("directory", directory).Debug("Directory doesn't exist. Creating...")
 		if err = os.MkdirAll(directory, os.FileMode(0700)); err != nil {
-			e <- err
-			return
+			return nil, err
 		}
 	} else if !fi.IsDir() {
-		e <- fmt.Errorf("Not a directory: %s", directory)
+		return nil, fmt.Errorf("Not a directory: %s", directory)
+	}
+	tmp, err := ioutil.TempFile(directory, fmt.Sprintf(".%s.", path.Base(filePath)))
+	if err != nil {
+		return nil, err
+	}
+	staged := &stagedFile{tmp: tmp.Name(), target: filePath}
+	// The permissions are set before writing anything so that the secret is
+	// never readable by anyone else, even temporarily
+	if err = tmp.Chmod(perm); err == nil {
+		if _, err = tmp.Write(secret); err == nil {
+			err = tmp.Sync()
+		}
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		staged.discard()
+		return nil, err
+	}
+	return staged, nil
+}
+
+// writeInFile atomically replaces the content of filePath with secret, so
+// that readers never see a partially written file.
+func (w *writer) writeInFile(filePath string, secret []byte, perm os.FileMode, e chan error) {
+	if w.keep([]*fileContent{{path: filePath, data: secret, perm: perm}}) {
+		e <- nil
 		return
 	}
-	if err := ioutil.WriteFile(filePath, secret, perm); err != nil {
+	if w.unchanged(filePath, secret, perm) {
+		e <- nil
+		return
+	}
+	log.Msg.WithField("file", filePath).Debug("Writing secret in file")
+	staged, err := w.stage(filePath, secret, perm)
+	if err != nil {
 		e <- err
 		return
 	}
+	if err := staged.commit(); err != nil {
+		e <- err
+		return
+	}
+	w.setChanged()
+	e <- nil
+	return
+}
+
+// writeInFiles replaces the content of several files together: all of them
+// are written to temporary files first, and only once every one of them has
+// been written successfully are they renamed over their targets, one right
+// after the other. If any of them fails to be written, none is replaced.
+func (w *writer) writeInFiles(files []*fileContent, e chan error) {
+	if w.keep(files) {
+		e <- nil
+		return
+	}
+	staged := make([]*stagedFile, 0, len(files))
+	for _, f := range files {
+		if w.unchanged(f.path, f.data, f.perm) {
+			continue
+		}
+		log.Msg.WithField("file", f.path).Debug("Writing secret in file")
+		s, err := w.stage(f.path, f.data, f.perm)
+		if err != nil {
+			for _, s := range staged {
+				s.discard()
+			}
+			e <- err
+			return
+		}
+		staged = append(staged, s)
+	}
+	for i, s := range staged {
+		if err := s.commit(); err != nil {
+			for _, s := range staged[i+1:] {
+				s.discard()
+			}
+			e <- err
+			return
+		}
+		w.setChanged()
+	}
 	e <- nil
 	return
 }
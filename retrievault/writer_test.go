@@ -0,0 +1,84 @@
+package retrievault
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWriteInFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := new(writer)
+	files := []*fileContent{
+		&fileContent{path.Join(dir, "cert.key"), []byte("key"), os.FileMode(0600)},
+		&fileContent{path.Join(dir, "certs", "cert.crt"), []byte("cert"), os.FileMode(0644)},
+	}
+	e := make(chan error, 1)
+	w.writeInFiles(files, e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if !w.Changed() {
+		t.Error("Expected the writer to report changes")
+	}
+	for _, f := range files {
+		content, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			t.Error("For", f.path, "expected nil error", "got", err)
+			continue
+		}
+		if string(content) != string(f.data) {
+			t.Error("For", f.path, "expected", string(f.data), "got", string(content))
+		}
+		fi, _ := os.Stat(f.path)
+		if fi.Mode().Perm() != f.perm {
+			t.Error("For", f.path, "expected", f.perm, "got", fi.Mode().Perm())
+		}
+	}
+
+	// Writing again must replace the files without leaving temporary files
+	w.writeInFile(files[0].path, []byte("new key"), os.FileMode(0600), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Error("Expected 2 entries in", dir, "got", len(entries))
+	}
+	content, _ := ioutil.ReadFile(files[0].path)
+	if string(content) != "new key" {
+		t.Error("For", files[0].path, "expected", "new key", "got", string(content))
+	}
+}
+
+func TestWriteInFileUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrievault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "secret")
+	if err := ioutil.WriteFile(file, []byte("secret"), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+	w := new(writer)
+	e := make(chan error, 1)
+	w.writeInFile(file, []byte("secret"), os.FileMode(0600), e)
+	if err := <-e; err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if w.Changed() {
+		t.Error("Expected the writer not to report changes")
+	}
+	fi, _ := os.Stat(file)
+	if fi.Mode().Perm() != os.FileMode(0600) {
+		t.Error("For", file, "expected", os.FileMode(0600), "got", fi.Mode().Perm())
+	}
+}